@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"os"
 	"os/signal"
@@ -103,6 +104,8 @@ func main() {
 	}
 	loggo.GetLogger("").Debugf(configString)
 
+	lxd2etcd.Version = version
+
 	// Create listener instance
 	service, err = lxd2etcd.NewService()
 	if err != nil {
@@ -131,7 +134,7 @@ func main() {
 
 	// Start service and wait
 	loggo.GetLogger("").Debugf("starting service...")
-	err = service.Start()
+	err = service.Start(context.Background())
 	if err != nil {
 		loggo.GetLogger("").Errorf(stacktrace.Propagate(err, "service error").Error())
 		err = service.Shutdown()
@@ -115,18 +115,159 @@ func (containers *ContainersConfig) Copy() *ContainersConfig {
 	return &copyCfg
 }
 
+// --- RemoteConfig section
+
+// RemoteConfig represents a single LXD source to follow: either a local unix socket or a
+// HTTPS endpoint (optionally a cluster) authenticated with a client certificate.
+type RemoteConfig struct {
+	Name       string   `yaml:"name"`
+	Socket     string   `yaml:"socket"`
+	URL        string   `yaml:"url"`
+	ClientCert string   `yaml:"client_cert"`
+	ClientKey  string   `yaml:"client_key"`
+	CA         string   `yaml:"ca"`
+	Projects   []string `yaml:"projects"`
+}
+
+func (remote *RemoteConfig) validate() error {
+	if remote.Name == "" {
+		return stacktrace.NewError("<name> field is required")
+	}
+	if remote.Socket == "" && remote.URL == "" {
+		return stacktrace.NewError("either <socket> or <url> field is required for remote <%s>", remote.Name)
+	}
+	if remote.Socket != "" && remote.URL != "" {
+		return stacktrace.NewError("<socket> and <url> are mutually exclusive for remote <%s>", remote.Name)
+	}
+	if remote.URL != "" && (remote.ClientCert == "" || remote.ClientKey == "") {
+		return stacktrace.NewError("<client_cert> and <client_key> are required for https remote <%s>", remote.Name)
+	}
+	return nil
+}
+
+// Equal tests if content is the same
+func (remote *RemoteConfig) Equal(comparedWith *RemoteConfig) error {
+	if comparedWith == nil {
+		return stacktrace.NewError("cannot compare with <nil>")
+	}
+	if remote.Name != comparedWith.Name {
+		return stacktrace.NewError("Name value <%s> is different: <%s>", remote.Name, comparedWith.Name)
+	}
+	if remote.Socket != comparedWith.Socket {
+		return stacktrace.NewError("Socket value <%s> is different: <%s>", remote.Socket, comparedWith.Socket)
+	}
+	if remote.URL != comparedWith.URL {
+		return stacktrace.NewError("URL value <%s> is different: <%s>", remote.URL, comparedWith.URL)
+	}
+	if remote.ClientCert != comparedWith.ClientCert {
+		return stacktrace.NewError("ClientCert value <%s> is different: <%s>", remote.ClientCert, comparedWith.ClientCert)
+	}
+	if remote.ClientKey != comparedWith.ClientKey {
+		return stacktrace.NewError("ClientKey value <%s> is different: <%s>", remote.ClientKey, comparedWith.ClientKey)
+	}
+	if remote.CA != comparedWith.CA {
+		return stacktrace.NewError("CA value <%s> is different: <%s>", remote.CA, comparedWith.CA)
+	}
+	if !reflect.DeepEqual(remote.Projects, comparedWith.Projects) {
+		return stacktrace.NewError("Projects value <%s> is different: <%s>", remote.Projects, comparedWith.Projects)
+	}
+	return nil
+}
+
+// Copy returns a copy of the object
+func (remote *RemoteConfig) Copy() *RemoteConfig {
+	copyCfg := *remote
+	copyCfg.Projects = make([]string, len(remote.Projects))
+	copy(copyCfg.Projects, remote.Projects)
+	return &copyCfg
+}
+
+// IsHTTPS returns true if the remote is reached over HTTPS instead of a local unix socket.
+func (remote *RemoteConfig) IsHTTPS() bool {
+	return remote.URL != ""
+}
+
+// RemotesConfig is the list of LXD remotes to follow.
+type RemotesConfig []RemoteConfig
+
+func (remotes *RemotesConfig) validate() error {
+	var (
+		err    error
+		remote RemoteConfig
+		seen   map[string]bool
+	)
+	if len(*remotes) == 0 {
+		return stacktrace.NewError("at least one remote is required")
+	}
+	seen = make(map[string]bool)
+	for _, remote = range *remotes {
+		err = remote.validate()
+		if err != nil {
+			return stacktrace.Propagate(err, "fail to validate remote")
+		}
+		if seen[remote.Name] {
+			return stacktrace.NewError("duplicate remote name <%s>", remote.Name)
+		}
+		seen[remote.Name] = true
+	}
+	return nil
+}
+
+// Equal tests if the current RemotesConfig contains the same values as the RemotesConfig in argument.
+func (remotes *RemotesConfig) Equal(comparedWith *RemotesConfig) error {
+	var (
+		err error
+		i   int
+	)
+	if comparedWith == nil {
+		return stacktrace.NewError("cannot compare with <nil>")
+	}
+	if len(*remotes) != len(*comparedWith) {
+		return stacktrace.NewError("remote count <%d> is different: <%d>", len(*remotes), len(*comparedWith))
+	}
+	for i = range *remotes {
+		err = (*remotes)[i].Equal(&(*comparedWith)[i])
+		if err != nil {
+			return stacktrace.Propagate(err, "remote at index <%d> is different", i)
+		}
+	}
+	return nil
+}
+
+// Copy returns a copy of the object.
+func (remotes *RemotesConfig) Copy() *RemotesConfig {
+	var (
+		copyCfg RemotesConfig
+		i       int
+	)
+	copyCfg = make(RemotesConfig, len(*remotes))
+	for i = range *remotes {
+		copyCfg[i] = *(*remotes)[i].Copy()
+	}
+	return &copyCfg
+}
+
 // --- LxdConfig section
 
-// LxdConfig represents the unix socket configuration
+// LxdConfig represents the set of LXD remotes to follow along with the refresh timings.
+//
+// MaxEventIdle, when non-zero, bounds how long the event listener may go without receiving any
+// LXD event before it is considered possibly wedged: past that interval, a liveness probe is sent
+// to the remote, and the listener is torn down and reconnected if the probe fails. A value of 0
+// disables the idle check.
 type LxdConfig struct {
-	Socket          string        `yaml:"socket"`
+	Remotes         RemotesConfig `yaml:"remotes"`
 	WaitForDHCP     time.Duration `yaml:"wait_for_dhcp"`
 	PeriodicRefresh time.Duration `yaml:"periodic_refresh"`
+	RefreshDebounce time.Duration `yaml:"refresh_debounce"`
+	MaxEventIdle    time.Duration `yaml:"max_event_idle"`
 }
 
 func (lxd *LxdConfig) validate() error {
-	if lxd.Socket == "" {
-		return stacktrace.NewError("<socket> field is required")
+	var err error
+	err = lxd.Remotes.validate()
+	if err != nil {
+		return stacktrace.Propagate(err, "fail to validate <remotes> field")
 	}
 	if lxd.WaitForDHCP == 0 {
 		return stacktrace.NewError("<wait_for_dhcp> field is required and should not be 0")
@@ -134,16 +275,21 @@ func (lxd *LxdConfig) validate() error {
 	if lxd.PeriodicRefresh == 0 {
 		return stacktrace.NewError("<periodic_refresh> field is required and should not be 0")
 	}
+	if lxd.RefreshDebounce == 0 {
+		return stacktrace.NewError("<refresh_debounce> field is required and should not be 0")
+	}
 	return nil
 }
 
 // Equal tests if content is the same
 func (lxd *LxdConfig) Equal(comparedWith *LxdConfig) error {
+	var err error
 	if comparedWith == nil {
 		return stacktrace.NewError("cannot compare with <nil>")
 	}
-	if lxd.Socket != comparedWith.Socket {
-		return stacktrace.NewError("Socket value <%s> is different: <%s>", lxd.Socket, comparedWith.Socket)
+	err = lxd.Remotes.Equal(&comparedWith.Remotes)
+	if err != nil {
+		return stacktrace.Propagate(err, "Remotes value is different")
 	}
 	if lxd.WaitForDHCP != comparedWith.WaitForDHCP {
 		return stacktrace.NewError("WaitForDHCP value <%s> is different: <%s>", lxd.WaitForDHCP, comparedWith.WaitForDHCP)
@@ -151,26 +297,40 @@ func (lxd *LxdConfig) Equal(comparedWith *LxdConfig) error {
 	if lxd.PeriodicRefresh != comparedWith.PeriodicRefresh {
 		return stacktrace.NewError("PeriodicRefresh value <%s> is different: <%s>", lxd.PeriodicRefresh, comparedWith.PeriodicRefresh)
 	}
+	if lxd.RefreshDebounce != comparedWith.RefreshDebounce {
+		return stacktrace.NewError("RefreshDebounce value <%s> is different: <%s>", lxd.RefreshDebounce, comparedWith.RefreshDebounce)
+	}
+	if lxd.MaxEventIdle != comparedWith.MaxEventIdle {
+		return stacktrace.NewError("MaxEventIdle value <%s> is different: <%s>", lxd.MaxEventIdle, comparedWith.MaxEventIdle)
+	}
 	return nil
 }
 
 // Copy returns a copy of the object
 func (lxd *LxdConfig) Copy() *LxdConfig {
 	return &LxdConfig{
-		Socket:          lxd.Socket,
+		Remotes:         *lxd.Remotes.Copy(),
 		WaitForDHCP:     lxd.WaitForDHCP,
 		PeriodicRefresh: lxd.PeriodicRefresh,
+		RefreshDebounce: lxd.RefreshDebounce,
+		MaxEventIdle:    lxd.MaxEventIdle,
 	}
 }
 
 // --- EtcdConfig section
 
 // EtcdConfig stores different parameters used for administrating the SFTP accounts
+//
+// LeaseTTL, when non-zero, has every key this node writes attached to a single lease kept alive
+// for the lifetime of the process, so that a node's data self-expires if the process dies without
+// a clean shutdown. Leases are scoped per Hostname: two lxd2etcd instances publishing under
+// different hostnames each get their own lease and never expire each other's keys.
 type EtcdConfig struct {
 	Endpoints   []string      `yaml:"endpoints"`
 	DialTimeout time.Duration `yaml:"dial_timeout"`
 	Username    string        `yaml:"username"`
 	Password    string        `yaml:"password"`
+	LeaseTTL    time.Duration `yaml:"lease_ttl"`
 }
 
 func (etcd *EtcdConfig) validate() error {
@@ -200,6 +360,9 @@ func (etcd *EtcdConfig) Equal(comparedWith *EtcdConfig) error {
 	if etcd.Password != comparedWith.Password {
 		return stacktrace.NewError("Password value <%s> is different: <%s>", etcd.Password, comparedWith.Password)
 	}
+	if etcd.LeaseTTL != comparedWith.LeaseTTL {
+		return stacktrace.NewError("LeaseTTL value <%s> is different: <%s>", etcd.LeaseTTL, comparedWith.LeaseTTL)
+	}
 	return nil
 }
 
@@ -210,9 +373,212 @@ func (etcd *EtcdConfig) Copy() *EtcdConfig {
 		DialTimeout: etcd.DialTimeout,
 		Username:    etcd.Username,
 		Password:    etcd.Password,
+		LeaseTTL:    etcd.LeaseTTL,
+	}
+}
+
+// --- HTTPConfig section
+
+// HTTPTLSConfig holds the certificate and key used to serve the admin HTTP endpoint over TLS.
+// Cert and Key must either both be set, to serve HTTPS, or both left empty, to serve plain HTTP.
+type HTTPTLSConfig struct {
+	Cert string `yaml:"cert"`
+	Key  string `yaml:"key"`
+}
+
+func (tls *HTTPTLSConfig) validate() error {
+	if (tls.Cert == "") != (tls.Key == "") {
+		return stacktrace.NewError("<cert> and <key> are mutually required")
+	}
+	return nil
+}
+
+// Equal tests if content is the same
+func (tls *HTTPTLSConfig) Equal(comparedWith *HTTPTLSConfig) error {
+	if comparedWith == nil {
+		return stacktrace.NewError("cannot compare with <nil>")
+	}
+	if tls.Cert != comparedWith.Cert {
+		return stacktrace.NewError("Cert value <%s> is different: <%s>", tls.Cert, comparedWith.Cert)
+	}
+	if tls.Key != comparedWith.Key {
+		return stacktrace.NewError("Key value <%s> is different: <%s>", tls.Key, comparedWith.Key)
+	}
+	return nil
+}
+
+// Copy returns a copy of the object
+func (tls *HTTPTLSConfig) Copy() *HTTPTLSConfig {
+	copyCfg := *tls
+	return &copyCfg
+}
+
+// HTTPBasicAuthConfig protects the admin HTTP endpoint with HTTP basic authentication. Left with
+// an empty Username, the endpoint is unauthenticated.
+type HTTPBasicAuthConfig struct {
+	Username string `yaml:"username"`
+	Password string `yaml:"password"`
+}
+
+// Equal tests if content is the same
+func (basicAuth *HTTPBasicAuthConfig) Equal(comparedWith *HTTPBasicAuthConfig) error {
+	if comparedWith == nil {
+		return stacktrace.NewError("cannot compare with <nil>")
+	}
+	if basicAuth.Username != comparedWith.Username {
+		return stacktrace.NewError("Username value <%s> is different: <%s>", basicAuth.Username, comparedWith.Username)
+	}
+	if basicAuth.Password != comparedWith.Password {
+		return stacktrace.NewError("Password value <%s> is different: <%s>", basicAuth.Password, comparedWith.Password)
+	}
+	return nil
+}
+
+// Copy returns a copy of the object
+func (basicAuth *HTTPBasicAuthConfig) Copy() *HTTPBasicAuthConfig {
+	copyCfg := *basicAuth
+	return &copyCfg
+}
+
+// HTTPConfig configures the optional embedded admin HTTP server exposing health probes and
+// Prometheus metrics (see AdminServer in the lxd2etcd package). The server is disabled when
+// Listen is empty.
+type HTTPConfig struct {
+	Listen    string              `yaml:"listen"`
+	TLS       HTTPTLSConfig       `yaml:"tls"`
+	BasicAuth HTTPBasicAuthConfig `yaml:"basic_auth"`
+}
+
+func (http *HTTPConfig) validate() error {
+	if http.Listen == "" {
+		return nil
+	}
+	return http.TLS.validate()
+}
+
+// Equal tests if content is the same
+func (http *HTTPConfig) Equal(comparedWith *HTTPConfig) error {
+	var err error
+	if comparedWith == nil {
+		return stacktrace.NewError("cannot compare with <nil>")
+	}
+	if http.Listen != comparedWith.Listen {
+		return stacktrace.NewError("Listen value <%s> is different: <%s>", http.Listen, comparedWith.Listen)
+	}
+	err = http.TLS.Equal(&comparedWith.TLS)
+	if err != nil {
+		return stacktrace.Propagate(err, "TLS value is different")
+	}
+	err = http.BasicAuth.Equal(&comparedWith.BasicAuth)
+	if err != nil {
+		return stacktrace.Propagate(err, "BasicAuth value is different")
+	}
+	return nil
+}
+
+// Copy returns a copy of the object
+func (http *HTTPConfig) Copy() *HTTPConfig {
+	return &HTTPConfig{
+		Listen:    http.Listen,
+		TLS:       *http.TLS.Copy(),
+		BasicAuth: *http.BasicAuth.Copy(),
 	}
 }
 
+// --- Projects section
+
+// ProjectData contains extraneous data added to configure how a given LXD project is exposed in etcd.
+// Prefix, when set, replaces the default etcd key prefix used for objects belonging to this project.
+type ProjectData struct {
+	Prefix string `yaml:"prefix"`
+}
+
+// ProjectsConfig configures project-scoped filtering and etcd key layout.
+// Allow and Deny are mutually exclusive: an empty Allow list means every project is followed
+// unless explicitly denied, a non-empty Allow list means only the listed projects are followed.
+type ProjectsConfig struct {
+	Allow []string               `yaml:"allow"`
+	Deny  []string               `yaml:"deny"`
+	Data  map[string]ProjectData `yaml:"data"`
+}
+
+func (projects *ProjectsConfig) validate() error {
+	if len(projects.Allow) > 0 && len(projects.Deny) > 0 {
+		return stacktrace.NewError("<allow> and <deny> are mutually exclusive")
+	}
+	return nil
+}
+
+// IsAllowed returns true if the given project should be followed according to the allow/deny lists.
+func (projects *ProjectsConfig) IsAllowed(project string) bool {
+	var (
+		allowed string
+		denied  string
+	)
+	if len(projects.Allow) > 0 {
+		for _, allowed = range projects.Allow {
+			if allowed == project {
+				return true
+			}
+		}
+		return false
+	}
+	for _, denied = range projects.Deny {
+		if denied == project {
+			return false
+		}
+	}
+	return true
+}
+
+// Prefix returns the etcd key prefix configured for the given project, or an empty string if none is configured.
+func (projects *ProjectsConfig) Prefix(project string) string {
+	var (
+		data ProjectData
+		ok   bool
+	)
+	data, ok = projects.Data[project]
+	if !ok {
+		return ""
+	}
+	return data.Prefix
+}
+
+// Equal tests if content is the same
+func (projects *ProjectsConfig) Equal(comparedWith *ProjectsConfig) error {
+	if comparedWith == nil {
+		return stacktrace.NewError("cannot compare with <nil>")
+	}
+	if !reflect.DeepEqual(projects.Allow, comparedWith.Allow) {
+		return stacktrace.NewError("Allow value <%s> is different: <%s>", projects.Allow, comparedWith.Allow)
+	}
+	if !reflect.DeepEqual(projects.Deny, comparedWith.Deny) {
+		return stacktrace.NewError("Deny value <%s> is different: <%s>", projects.Deny, comparedWith.Deny)
+	}
+	if !reflect.DeepEqual(projects.Data, comparedWith.Data) {
+		return stacktrace.NewError("Data value <%#v> is different: <%#v>", projects.Data, comparedWith.Data)
+	}
+	return nil
+}
+
+// Copy returns a copy of the object
+func (projects *ProjectsConfig) Copy() *ProjectsConfig {
+	var (
+		copyCfg ProjectsConfig
+		key     string
+		value   ProjectData
+	)
+	copyCfg.Allow = make([]string, len(projects.Allow))
+	copy(copyCfg.Allow, projects.Allow)
+	copyCfg.Deny = make([]string, len(projects.Deny))
+	copy(copyCfg.Deny, projects.Deny)
+	copyCfg.Data = make(map[string]ProjectData)
+	for key, value = range projects.Data {
+		copyCfg.Data[key] = value
+	}
+	return &copyCfg
+}
+
 // --- Global Config section
 
 // Config file structure definition
@@ -222,6 +588,8 @@ type Config struct {
 	Lxd        LxdConfig        `yaml:"lxd"`
 	Etcd       EtcdConfig       `yaml:"etcd"`
 	Containers ContainersConfig `yaml:"containers"`
+	Projects   ProjectsConfig   `yaml:"projects"`
+	HTTP       HTTPConfig       `yaml:"http"`
 }
 
 func (c *Config) validate() error {
@@ -243,6 +611,14 @@ func (c *Config) validate() error {
 	if err != nil {
 		return stacktrace.Propagate(err, "fail to validate <containers> section")
 	}
+	err = c.Projects.validate()
+	if err != nil {
+		return stacktrace.Propagate(err, "fail to validate <projects> section")
+	}
+	err = c.HTTP.validate()
+	if err != nil {
+		return stacktrace.Propagate(err, "fail to validate <http> section")
+	}
 	return nil
 }
 
@@ -277,6 +653,14 @@ func (c *Config) Equal(comparedWith *Config) error {
 	if err != nil {
 		return stacktrace.Propagate(err, "containers section is different")
 	}
+	err = c.Projects.Equal(&comparedWith.Projects)
+	if err != nil {
+		return stacktrace.Propagate(err, "projects section is different")
+	}
+	err = c.HTTP.Equal(&comparedWith.HTTP)
+	if err != nil {
+		return stacktrace.Propagate(err, "http section is different")
+	}
 	return nil
 }
 
@@ -370,6 +754,22 @@ func GetContainers() *ContainersConfig {
 	return Configuration.Containers.Copy()
 }
 
+// GetProjects returns the projects config section
+func GetProjects() *ProjectsConfig {
+	lock.Lock()
+	defer lock.Unlock()
+
+	return Configuration.Projects.Copy()
+}
+
+// GetHTTP returns the http config section
+func GetHTTP() *HTTPConfig {
+	lock.Lock()
+	defer lock.Unlock()
+
+	return Configuration.HTTP.Copy()
+}
+
 // GetHostname returns hostname config field.
 func GetHostname() string {
 	lock.Lock()
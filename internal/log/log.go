@@ -0,0 +1,94 @@
+// Package log wraps loggo with support for structured contextual fields, à la go-ethereum's
+// log15: New (or an existing Logger's WithFields/With) returns a child Logger that prepends its
+// accumulated "key=value" fields to every line it logs, so that eg every line emitted while
+// processing one container can be tagged with that container's name without repeating it in every
+// format string.
+package log
+
+import (
+	"fmt"
+
+	"github.com/juju/loggo"
+)
+
+// Logger wraps a loggo.Logger together with a set of key/value fields accumulated through With
+// and WithFields.
+type Logger struct {
+	backend loggo.Logger
+	fields  string
+}
+
+// New returns a Logger wrapping loggo's root logger, optionally pre-populated with the given
+// alternating key/value context fields, eg log.New("container", name).
+func New(ctx ...interface{}) Logger {
+	return Logger{backend: loggo.GetLogger("")}.WithFields(ctx...)
+}
+
+// With returns a child Logger tagging every line it (or any of its own children) logs with an
+// additional key=value field, leaving lg itself untouched.
+func (lg Logger) With(key string, value interface{}) Logger {
+	return Logger{backend: lg.backend, fields: lg.appendField(key, value)}
+}
+
+// WithFields returns a child Logger tagging every line it logs with the given alternating
+// key/value context fields, eg lg.WithFields("netdev", name, "mac", mac).
+func (lg Logger) WithFields(ctx ...interface{}) Logger {
+	child := lg
+	for i := 0; i+1 < len(ctx); i += 2 {
+		key, _ := ctx[i].(string)
+		child = child.With(key, ctx[i+1])
+	}
+	return child
+}
+
+func (lg Logger) appendField(key string, value interface{}) string {
+	field := fmt.Sprintf("%s=%v", key, value)
+	if lg.fields == "" {
+		return field
+	}
+	return lg.fields + " " + field
+}
+
+func (lg Logger) message(format string) string {
+	if lg.fields == "" {
+		return format
+	}
+	return lg.fields + ": " + format
+}
+
+// TraceEnabled reports whether Trace-level messages are currently logged, so that callers can
+// skip building expensive arguments (eg "%#v" of a large struct) that would otherwise be
+// discarded unused.
+func (lg Logger) TraceEnabled() bool {
+	return lg.backend.IsTraceEnabled()
+}
+
+// Criticalf logs a message at critical level.
+func (lg Logger) Criticalf(format string, args ...interface{}) {
+	lg.backend.Criticalf(lg.message(format), args...)
+}
+
+// Errorf logs a message at error level.
+func (lg Logger) Errorf(format string, args ...interface{}) {
+	lg.backend.Errorf(lg.message(format), args...)
+}
+
+// Warningf logs a message at warning level.
+func (lg Logger) Warningf(format string, args ...interface{}) {
+	lg.backend.Warningf(lg.message(format), args...)
+}
+
+// Infof logs a message at info level.
+func (lg Logger) Infof(format string, args ...interface{}) {
+	lg.backend.Infof(lg.message(format), args...)
+}
+
+// Debugf logs a message at debug level.
+func (lg Logger) Debugf(format string, args ...interface{}) {
+	lg.backend.Debugf(lg.message(format), args...)
+}
+
+// Tracef logs a message at trace level.
+func (lg Logger) Tracef(format string, args ...interface{}) {
+	lg.backend.Tracef(lg.message(format), args...)
+}
@@ -1,24 +1,12 @@
 package lxd2etcd
 
-import (
-	"fmt"
-	"strings"
-
-	"github.com/lxc/lxd/shared/api"
-)
-
-type LxdEventHandler struct {
-	Types   []string
-	Handler func(chan struct{}, api.Event) error
-}
-
-func LxdEventToString(event api.Event) string {
-	var (
-		builder strings.Builder
-	)
-	builder.WriteString(fmt.Sprintf("Type:%s, ", event.Type))
-	builder.WriteString(fmt.Sprintf("Timestamp:%s, ", event.Timestamp.Format("2006-01-02 15:04:05")))
-	builder.WriteString("Metadata:")
-	builder.Write(event.Metadata)
-	return builder.String()
+// RefreshRequest describes a single LXD object that changed and needs its etcd entry refreshed
+// (re-queried and re-written) or removed, instead of triggering a full inventory refresh.
+type RefreshRequest struct {
+	Remote   string
+	Project  string
+	Location string // cluster member the event was received from, "" for a non-clustered remote
+	Kind     string // "instance" or "network"
+	Name     string
+	Action   string // raw lifecycle action, eg "instance-updated", "network-deleted"
 }
@@ -0,0 +1,138 @@
+package lxd2etcd
+
+import (
+	"context"
+	"crypto/subtle"
+	"fmt"
+	"net/http"
+
+	"github.com/limhud/lxd2etcd/internal/config"
+
+	"github.com/juju/loggo"
+	"github.com/palantir/stacktrace"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// AdminServer is an optional embedded HTTP server exposing health probes, Prometheus metrics and
+// a debug endpoint for service, used to monitor lxd2etcd itself.
+type AdminServer struct {
+	httpServer *http.Server
+	tlsCert    string
+	tlsKey     string
+	service    *Service
+}
+
+// NewAdminServer builds the admin HTTP server for service, or returns nil if no <listen> address
+// is configured in the http config section.
+func NewAdminServer(service *Service) *AdminServer {
+	var (
+		httpConfig *config.HTTPConfig
+		mux        *http.ServeMux
+		admin      *AdminServer
+	)
+	httpConfig = config.GetHTTP()
+	if httpConfig.Listen == "" {
+		return nil
+	}
+	admin = &AdminServer{service: service, tlsCert: httpConfig.TLS.Cert, tlsKey: httpConfig.TLS.Key}
+	mux = http.NewServeMux()
+	mux.HandleFunc("/healthz", admin.handleHealthz)
+	mux.HandleFunc("/readyz", admin.handleReadyz)
+	mux.Handle("/metrics", promhttp.Handler())
+	mux.HandleFunc("/debug/state", admin.handleDebugState)
+	mux.HandleFunc("/debug/event-idle", admin.handleEventIdle)
+	admin.httpServer = &http.Server{
+		Addr:    httpConfig.Listen,
+		Handler: basicAuthMiddleware(httpConfig.BasicAuth, mux),
+	}
+	return admin
+}
+
+// basicAuthMiddleware wraps next with HTTP basic authentication, unless basicAuth.Username is
+// empty, in which case next is returned unmodified and the admin server stays unauthenticated.
+func basicAuthMiddleware(basicAuth config.HTTPBasicAuthConfig, next http.Handler) http.Handler {
+	if basicAuth.Username == "" {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var (
+			user string
+			pass string
+			ok   bool
+		)
+		user, pass, ok = r.BasicAuth()
+		if !ok || subtle.ConstantTimeCompare([]byte(user), []byte(basicAuth.Username)) != 1 ||
+			subtle.ConstantTimeCompare([]byte(pass), []byte(basicAuth.Password)) != 1 {
+			w.Header().Set("WWW-Authenticate", `Basic realm="lxd2etcd"`)
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// Start starts serving the admin HTTP server in the background, reporting unexpected errors
+// (anything other than the clean close triggered by Shutdown) on errorChan.
+func (admin *AdminServer) Start(errorChan chan error) {
+	go func() {
+		var err error
+		if admin.tlsCert != "" {
+			err = admin.httpServer.ListenAndServeTLS(admin.tlsCert, admin.tlsKey)
+		} else {
+			err = admin.httpServer.ListenAndServe()
+		}
+		if err != nil && err != http.ErrServerClosed {
+			errorChan <- stacktrace.Propagate(err, "admin http server error")
+		}
+	}()
+	loggo.GetLogger("").Infof("admin http server listening on <%s>", admin.httpServer.Addr)
+}
+
+// Shutdown gracefully stops the admin HTTP server.
+func (admin *AdminServer) Shutdown(ctx context.Context) error {
+	var err error
+	err = admin.httpServer.Shutdown(ctx)
+	if err != nil {
+		return stacktrace.Propagate(err, "fail to shutdown admin http server")
+	}
+	return nil
+}
+
+// handleHealthz reports whether the service could reach LXD and etcd on its last (re)connection
+// attempt. It returns 503 while that connection is down, regardless of whether any data has been
+// populated yet.
+func (admin *AdminServer) handleHealthz(w http.ResponseWriter, r *http.Request) {
+	if !admin.service.isHealthy() {
+		http.Error(w, "unhealthy", http.StatusServiceUnavailable)
+		return
+	}
+	fmt.Fprintln(w, "ok")
+}
+
+// handleReadyz reports whether the service has completed at least one full populate/persist
+// cycle, ie it has something meaningful published in etcd.
+func (admin *AdminServer) handleReadyz(w http.ResponseWriter, r *http.Request) {
+	if !admin.service.isReady() {
+		http.Error(w, "not ready", http.StatusServiceUnavailable)
+		return
+	}
+	fmt.Fprintln(w, "ok")
+}
+
+// handleEventIdle reports how long it has been since the lxd-listener sub-service last received
+// an LXD event, letting external supervisors detect a silently wedged event stream before it is
+// caught and reconnected on its own.
+func (admin *AdminServer) handleEventIdle(w http.ResponseWriter, r *http.Request) {
+	fmt.Fprintln(w, admin.service.eventIdleDuration())
+}
+
+// handleDebugState dumps the last populated LxdInfo for troubleshooting.
+func (admin *AdminServer) handleDebugState(w http.ResponseWriter, r *http.Request) {
+	var lxdInfo *LxdInfo
+	lxdInfo = admin.service.lastLxdInfo()
+	if lxdInfo == nil {
+		http.Error(w, "no data populated yet", http.StatusServiceUnavailable)
+		return
+	}
+	fmt.Fprintln(w, lxdInfo.PrettyString())
+}
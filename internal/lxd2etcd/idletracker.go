@@ -0,0 +1,33 @@
+package lxd2etcd
+
+import (
+	"sync"
+	"time"
+)
+
+// eventIdleTracker records the time of the last event received off an LXD event listener, so that
+// a silently wedged connection (the listener reports itself active, but no events are ever
+// arriving any more) can be detected. Inspired by podman's API idletracker.
+type eventIdleTracker struct {
+	lock     sync.Mutex
+	lastSeen time.Time
+}
+
+// newEventIdleTracker returns a tracker considering itself fresh as of now.
+func newEventIdleTracker() *eventIdleTracker {
+	return &eventIdleTracker{lastSeen: time.Now()}
+}
+
+// touch records that an event (or a fresh (re)connection) was just observed.
+func (tracker *eventIdleTracker) touch() {
+	tracker.lock.Lock()
+	defer tracker.lock.Unlock()
+	tracker.lastSeen = time.Now()
+}
+
+// idleFor returns how long it has been since the last recorded event.
+func (tracker *eventIdleTracker) idleFor() time.Duration {
+	tracker.lock.Lock()
+	defer tracker.lock.Unlock()
+	return time.Since(tracker.lastSeen)
+}
@@ -10,22 +10,60 @@ import (
 	"github.com/palantir/stacktrace"
 )
 
-// HandleLxdEvent is run for each received event from LXD.
-// It triggers a config refresh according to the event.
-func HandleLxdEvent(refreshChan chan struct{}, event api.Event) error {
+// eventSourceKind returns the RefreshRequest.Kind matching a lifecycle action prefix, or an empty
+// string if the action does not refer to an instance or a network.
+func eventSourceKind(action string) string {
+	if strings.HasPrefix(action, "instance-") || strings.HasPrefix(action, "virtual-machine-") {
+		return "instance"
+	}
+	if strings.HasPrefix(action, "network-") {
+		return "network"
+	}
+	return ""
+}
+
+// sourceName extracts the object name from an LXD API source path, eg "/1.0/instances/c1" or
+// "/1.0/networks/br0?project=foo".
+func sourceName(source string) string {
+	var parts []string
+	source = strings.SplitN(source, "?", 2)[0]
+	parts = strings.Split(source, "/")
+	return parts[len(parts)-1]
+}
+
+// HandleLxdEvent is run for each received event from LXD. project is the project the event was
+// received for: the pinned lxc/lxd client version does not expose a Project field on api.Event, so
+// the event listener is instead connected per-project (see lxdListenerService.Serve) and passes its
+// own project down to the handler.
+// It pushes a RefreshRequest describing the changed object so that only that object is re-queried
+// and re-written to etcd, instead of triggering a full inventory refresh.
+func HandleLxdEvent(refreshChan chan RefreshRequest, remote string, project string, event api.Event) error {
 	var (
 		err     error
 		lcEvent *api.EventLifecycle
+		kind    string
 	)
 	lcEvent = &api.EventLifecycle{}
 	err = json.Unmarshal(event.Metadata, lcEvent)
 	if err != nil {
+		errorsTotal.WithLabelValues("lxd_event").Inc()
 		return stacktrace.Propagate(err, "fail to unmarshal <%s> into EventLifecycle", string(event.Metadata))
 	}
-	if strings.HasPrefix(lcEvent.Action, "instance-") || strings.HasPrefix(lcEvent.Action, "network-") {
-		loggo.GetLogger("").Tracef("triggering refresh for action <%s>", lcEvent.Action)
-		refreshChan <- struct{}{}
+	eventsReceivedTotal.WithLabelValues(lcEvent.Action).Inc()
+	kind = eventSourceKind(lcEvent.Action)
+	if kind == "" {
+		return nil
+	}
+	loggo.GetLogger("").Tracef("triggering refresh for action <%s> on source <%s>", lcEvent.Action, lcEvent.Source)
+	refreshChan <- RefreshRequest{
+		Remote:   remote,
+		Project:  project,
+		Location: event.Location,
+		Kind:     kind,
+		Name:     sourceName(lcEvent.Source),
+		Action:   lcEvent.Action,
 	}
+	refreshesTriggeredTotal.Inc()
 	return nil
 }
 
@@ -34,7 +72,6 @@ func LxdEventToString(event api.Event) string {
 	var (
 		builder strings.Builder
 	)
-	builder.WriteString(fmt.Sprintf("Project:%s, ", event.Project))
 	builder.WriteString(fmt.Sprintf("Location:%s, ", event.Location))
 	builder.WriteString(fmt.Sprintf("Type:%s, ", event.Type))
 	builder.WriteString(fmt.Sprintf("Timestamp:%s, ", event.Timestamp.Format("2006-01-02 15:04:05")))
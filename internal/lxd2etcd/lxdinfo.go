@@ -5,10 +5,11 @@ import (
 	"context"
 	"encoding/json"
 	"fmt"
+	"time"
 
 	"github.com/limhud/lxd2etcd/internal/config"
+	"github.com/limhud/lxd2etcd/internal/log"
 
-	"github.com/juju/loggo"
 	"github.com/lxc/lxd/client"
 	"github.com/lxc/lxd/shared/api"
 	"github.com/palantir/stacktrace"
@@ -17,11 +18,24 @@ import (
 
 // NetworkInfo represents retrieved info about a particular network
 type NetworkInfo struct {
-	MAC string `json:"mac"`
+	Name     string `json:"name"`
+	Remote   string `json:"remote"`
+	Location string `json:"location"`
+	Project  string `json:"project"`
+	MAC      string `json:"mac"`
+}
+
+// MetaInfo is published alongside a (remote, project)'s networks and instances, at the "meta" key
+// of their common prefix, so that consumers can tell when that prefix was last refreshed and by
+// which lxd2etcd build.
+type MetaInfo struct {
+	LastRefresh time.Time `json:"last_refresh"`
+	Version     string    `json:"version"`
 }
 
 // NetDev represents a network device (interface) of a container
 type NetDev struct {
+	Project string   `json:"project"`
 	Network string   `json:"network"`
 	Port    string   `json:"port"`
 	MAC     string   `json:"mac"`
@@ -29,8 +43,13 @@ type NetDev struct {
 	IPv6    []string `json:"ipv6"`
 }
 
-// ContainerInfo represents infos about a specific container
+// ContainerInfo represents infos about a specific instance (container or virtual-machine)
 type ContainerInfo struct {
+	Name             string             `json:"name"`
+	Remote           string             `json:"remote"`
+	Location         string             `json:"location"`
+	Project          string             `json:"project"`
+	Type             string             `json:"type"`
 	Status           string             `json:"status"`
 	DefaultInterface string             `json:"default_interface"`
 	DefaultIPv4      []string           `json:"default_ipv4"`
@@ -39,120 +58,587 @@ type ContainerInfo struct {
 	NetDevs          map[string]*NetDev `json:"netdevs"`
 }
 
-// LxdInfo contains info abouts networks and containers on the Lxd node
+// LxdInfo contains info abouts networks and instances (containers and virtual-machines) on the Lxd node
 type LxdInfo struct {
 	Networks   map[string]*NetworkInfo   `json:"networks"`
 	Containers map[string]*ContainerInfo `json:"containers"`
 }
 
-// Populate retrieve infos from lxd and fill the data in the structure
-func (lxdInfo *LxdInfo) Populate(instanceServer lxd.InstanceServer) error {
+// RemoteSource pairs a connected LXD API client with the remote (and, for a clustered HTTPS
+// remote, the cluster member location) and project it was obtained from. LxdInfo.Populate
+// iterates one RemoteSource per remote/location/project combination to follow. InstanceServer
+// is expected to already be scoped to Project (via InstanceServer.UseProject).
+type RemoteSource struct {
+	Remote         string
+	Location       string
+	Project        string
+	InstanceServer lxd.InstanceServer
+}
+
+// key builds the map key used to index Networks/Containers, namespacing by remote, location and
+// project so that two remotes, cluster members or projects never collide on object name.
+func (source *RemoteSource) key(name string) string {
+	return objectKey(source.Remote, source.Location, source.Project, name)
+}
+
+// objectKey builds the map key used to index Networks/Containers, namespacing by remote, location
+// and project so that two remotes, cluster members or projects never collide on object name. It is
+// shared by RemoteSource.key and by loadPreviousFromEtcd, which derives remote/location/project
+// from an already-retrieved NetworkInfo/ContainerInfo rather than from a RemoteSource.
+func objectKey(remote string, location string, project string, name string) string {
+	if location == "" {
+		return fmt.Sprintf("%s/%s/%s", remote, project, name)
+	}
+	return fmt.Sprintf("%s/%s/%s/%s", remote, location, project, name)
+}
+
+// leafName returns the etcd leaf key to use for a single object of this source, namespacing by
+// cluster member location only (project is already carried by the rest of the key, and remote by
+// the default prefix, see remoteProjectKey.prefix; a project with a configured prefix has no
+// remote in its keys) so that two cluster members never collide on the same object name.
+func (source *RemoteSource) leafName(name string) string {
+	return leafName(source.Location, name)
+}
+
+// leafName returns the etcd leaf key to use for a single object found at location (namespacing by
+// cluster member location only, so that two cluster members never collide on the same object name).
+// It is shared by RemoteSource.leafName and by LxdInfo.Persist, which derives location from the
+// already-retrieved NetworkInfo/ContainerInfo rather than from a RemoteSource.
+func leafName(location string, name string) string {
+	if location == "" {
+		return name
+	}
+	return fmt.Sprintf("%s/%s", location, name)
+}
+
+// buildNetworkInfo assembles a NetworkInfo from freshly retrieved LXD network state.
+func buildNetworkInfo(source RemoteSource, name string, networkState *api.NetworkState) *NetworkInfo {
+	return &NetworkInfo{Name: name, Remote: source.Remote, Location: source.Location, Project: source.Project, MAC: networkState.Hwaddr}
+}
+
+// buildContainerInfo assembles a ContainerInfo from freshly retrieved LXD instance data. lg is
+// expected to already carry the container's identifying fields (eg "container=c1"); a child
+// logger tagged with the network device name is derived for each entry of state.Network.
+func buildContainerInfo(lg log.Logger, source RemoteSource, name string, typ string, status string, expandedDevices map[string]map[string]string, state *api.InstanceState) *ContainerInfo {
 	var (
-		err                 error
-		networks            []api.Network
-		network             api.Network
-		networkInfo         *NetworkInfo
-		networkState        *api.NetworkState
-		containers          []api.ContainerFull
-		container           api.ContainerFull
 		containerInfo       *ContainerInfo
 		containersExtraData *config.ContainerData
 		netname             string
-		net                 api.ContainerStateNetwork
+		net                 api.InstanceStateNetwork
 		netdev              *NetDev
-		instanceAddress     api.ContainerStateNetworkAddress
+		netLg               log.Logger
+		instanceAddress     api.InstanceStateNetworkAddress
+	)
+	containerInfo = &ContainerInfo{Name: name, Remote: source.Remote, Location: source.Location, Project: source.Project}
+	containerInfo.Type = typ
+	containerInfo.Status = status
+	// enrich with data from containers section of config
+	containersExtraData = config.GetContainers().Get(name)
+	containerInfo.NodeIP = containersExtraData.NodeIP
+	containerInfo.DefaultInterface = containersExtraData.DefaultInterface
+	// fill network device info
+	containerInfo.NetDevs = make(map[string]*NetDev)
+	for netname, net = range state.Network {
+		netLg = lg.With("netdev", netname)
+		if netLg.TraceEnabled() {
+			netLg.Tracef("processing instance network: <%#v>", net)
+		}
+		netdev = &NetDev{Project: source.Project}
+		netdev.Network = expandedDevices[netname]["network"]
+		netdev.Port = net.HostName
+		netdev.MAC = net.Hwaddr
+		netdev.IPv4 = []string{}
+		netdev.IPv6 = []string{}
+		for _, instanceAddress = range net.Addresses {
+			if netLg.TraceEnabled() {
+				netLg.Tracef("processing net device address: <%#v>", instanceAddress)
+			}
+			if instanceAddress.Family == "inet" {
+				netdev.IPv4 = append(netdev.IPv4, fmt.Sprintf("%s/%s", instanceAddress.Address, instanceAddress.Netmask))
+			} else {
+				netdev.IPv6 = append(netdev.IPv6, fmt.Sprintf("%s/%s", instanceAddress.Address, instanceAddress.Netmask))
+			}
+		}
+		containerInfo.NetDevs[netname] = netdev
+		// set default_ip
+		if netname == containersExtraData.DefaultInterface {
+			containerInfo.DefaultIPv4 = netdev.IPv4
+			containerInfo.DefaultIPv6 = netdev.IPv6
+		}
+	}
+	return containerInfo
+}
+
+// Populate retrieve infos from lxd and fill the data in the structure
+func (lxdInfo *LxdInfo) Populate(sources []RemoteSource) error {
+	var (
+		err          error
+		start        time.Time
+		source       RemoteSource
+		sourceLg     log.Logger
+		networks     []api.Network
+		network      api.Network
+		networkLg    log.Logger
+		networkState *api.NetworkState
+		instances    []api.InstanceFull
+		instance     api.InstanceFull
+		containerLg  log.Logger
 	)
+	start = time.Now()
+	defer func() { populateDurationSeconds.Observe(time.Since(start).Seconds()) }()
 	lxdInfo.Networks = make(map[string]*NetworkInfo)
 	lxdInfo.Containers = make(map[string]*ContainerInfo)
-	// network infos
-	loggo.GetLogger("").Debugf("retrieve network infos")
-	networks, err = instanceServer.GetNetworks()
+	for _, source = range sources {
+		sourceLg = log.New("remote", source.Remote, "location", source.Location)
+		sourceLg.Debugf("retrieve infos from remote")
+		// network infos
+		sourceLg.Debugf("retrieve network infos")
+		networks, err = source.InstanceServer.GetNetworks()
+		if err != nil {
+			errorsTotal.WithLabelValues("populate").Inc()
+			return stacktrace.Propagate(err, "fail to retrieve networks from remote <%s>", source.Remote)
+		}
+		for _, network = range networks {
+			networkLg = sourceLg.With("network", network.Name)
+			if networkLg.TraceEnabled() {
+				networkLg.Tracef("processing network: <%#v>", network)
+			}
+			networkState, err = source.InstanceServer.GetNetworkState(network.Name)
+			if err != nil {
+				errorsTotal.WithLabelValues("populate").Inc()
+				return stacktrace.Propagate(err, "fail to retrieve state of network <%s> on remote <%s>", network.Name, source.Remote)
+			}
+			lxdInfo.Networks[source.key(network.Name)] = buildNetworkInfo(source, network.Name, networkState)
+		}
+		// instance infos (containers and virtual-machines)
+		sourceLg.Debugf("retrieve instance infos")
+		instances, err = source.InstanceServer.GetInstancesFull(api.InstanceTypeAny)
+		if err != nil {
+			errorsTotal.WithLabelValues("populate").Inc()
+			return stacktrace.Propagate(err, "fail to retrieve instances from remote <%s>", source.Remote)
+		}
+		for _, instance = range instances {
+			containerLg = sourceLg.With("container", instance.Name)
+			if containerLg.TraceEnabled() {
+				containerLg.Tracef("processing instance: <%#v>", instance)
+			}
+			lxdInfo.Containers[source.key(instance.Name)] = buildContainerInfo(containerLg, source, instance.Name, instance.Type, instance.Status, instance.ExpandedDevices, instance.State)
+		}
+	}
+	trackedNetworksGauge.Set(float64(len(lxdInfo.Networks)))
+	trackedInstancesGauge.Set(float64(len(lxdInfo.Containers)))
+	return nil
+}
+
+// remoteProjectKey identifies a (remote, project) pair used to group data for persistence.
+type remoteProjectKey struct {
+	Remote  string
+	Project string
+}
+
+// prefix returns the etcd key prefix to use for this (remote, project) pair: the project's
+// configured prefix if any, otherwise the default "/lxd/<hostname>/<remote>" prefix.
+func (rpk *remoteProjectKey) prefix() string {
+	var configuredPrefix string
+	configuredPrefix = config.GetProjects().Prefix(rpk.Project)
+	if configuredPrefix != "" {
+		return configuredPrefix
+	}
+	return fmt.Sprintf("/lxd/%s/%s", config.GetHostname(), rpk.Remote)
+}
+
+// networkKey returns the etcd key of a single network entry.
+func networkKey(rpk remoteProjectKey, leaf string) string {
+	return fmt.Sprintf("%s/projects/%s/networks/%s", rpk.prefix(), rpk.Project, leaf)
+}
+
+// containerKey returns the etcd key of a single instance's entry in the flat "containers"
+// compatibility view (all instance types together, for consumers that don't care about the
+// container/virtual-machine distinction).
+func containerKey(rpk remoteProjectKey, leaf string) string {
+	return fmt.Sprintf("%s/projects/%s/containers/%s", rpk.prefix(), rpk.Project, leaf)
+}
+
+// instanceKey returns the etcd key of a single instance's entry under its type ("container" or
+// "virtual-machine").
+func instanceKey(rpk remoteProjectKey, typ string, leaf string) string {
+	return fmt.Sprintf("%s/projects/%s/instances/%s/%s", rpk.prefix(), rpk.Project, typ, leaf)
+}
+
+// metaKey returns the etcd key holding a (remote, project)'s MetaInfo.
+func metaKey(rpk remoteProjectKey) string {
+	return fmt.Sprintf("%s/projects/%s/meta", rpk.prefix(), rpk.Project)
+}
+
+// putOp marshals value to JSON and returns the etcd Put operation for it, attached to leaseID
+// (clientv3.NoLease if leases are disabled).
+func putOp(key string, value interface{}, leaseID clientv3.LeaseID) (clientv3.Op, error) {
+	var (
+		err     error
+		binJSON []byte
+	)
+	binJSON, err = json.Marshal(value)
 	if err != nil {
-		return stacktrace.Propagate(err, "fail to retrieve networks")
+		return clientv3.Op{}, stacktrace.Propagate(err, "fail to serialize <%#v>", value)
+	}
+	return clientv3.OpPut(key, string(binJSON), clientv3.WithLease(leaseID)), nil
+}
+
+// commitTxn applies ops as a single etcd transaction, so that consumers watching a prefix never
+// observe a partially applied refresh, then updates the etcd put/delete counters and write
+// latency histogram. It is a no-op if ops is empty.
+func commitTxn(ctx context.Context, etcdClient *clientv3.Client, ops []clientv3.Op) error {
+	var (
+		err     error
+		start   time.Time
+		op      clientv3.Op
+		puts    int
+		deletes int
+	)
+	if len(ops) == 0 {
+		return nil
 	}
-	for _, network = range networks {
-		loggo.GetLogger("").Tracef("processing network: <%#v>", network)
-		networkInfo = &NetworkInfo{}
-		networkState, err = instanceServer.GetNetworkState(network.Name)
+	for _, op = range ops {
+		if op.IsDelete() {
+			deletes++
+		} else {
+			puts++
+		}
+	}
+	start = time.Now()
+	_, err = etcdClient.Txn(ctx).Then(ops...).Commit()
+	etcdWriteLatencySeconds.Observe(time.Since(start).Seconds())
+	if err != nil {
+		errorsTotal.WithLabelValues("etcd_put").Inc()
+		return stacktrace.Propagate(err, "fail to commit etcd transaction with <%d> operation(s)", len(ops))
+	}
+	etcdPutsTotal.Add(float64(puts))
+	etcdDeletesTotal.Add(float64(deletes))
+	return nil
+}
+
+// Persist takes the data in the structure and stores it into etcd: one key per network and per
+// instance (under both the flat "containers" compatibility view and the "instances/<type>" view),
+// plus a "meta" key with the refresh timestamp and agent version, for every (remote, project) with
+// at least one entry. Writing one key per object (instead of one JSON blob per (remote, project))
+// lets consumers Watch a single container or network and react to only its own changes. previous,
+// the last snapshot successfully persisted (nil before the first), is diffed against lxdInfo to
+// issue explicit Deletes for objects that vanished since then. Every write, including deletes, is
+// applied in a single etcd transaction so that consumers never observe a half-applied refresh.
+// Every key is attached to leaseID (clientv3.NoLease if leases are disabled) so that the whole
+// node's data can self-expire if the agent dies uncleanly.
+func (lxdInfo *LxdInfo) Persist(ctx context.Context, etcdClient *clientv3.Client, leaseID clientv3.LeaseID, previous *LxdInfo) error {
+	var (
+		err           error
+		ops           []clientv3.Op
+		op            clientv3.Op
+		name          string
+		rpk           remoteProjectKey
+		networkInfo   *NetworkInfo
+		containerInfo *ContainerInfo
+		touchedRPKs   map[remoteProjectKey]bool
+		touched       bool
+	)
+	touchedRPKs = make(map[remoteProjectKey]bool)
+	for name, networkInfo = range lxdInfo.Networks {
+		rpk = remoteProjectKey{Remote: networkInfo.Remote, Project: networkInfo.Project}
+		touchedRPKs[rpk] = true
+		op, err = putOp(networkKey(rpk, leafName(networkInfo.Location, networkInfo.Name)), networkInfo, leaseID)
 		if err != nil {
-			return stacktrace.Propagate(err, "fail to retrieve state of network <%s>", network.Name)
+			return err
 		}
-		networkInfo.MAC = networkState.Hwaddr
-		lxdInfo.Networks[network.Name] = networkInfo
+		ops = append(ops, op)
 	}
-	// container infos
-	loggo.GetLogger("").Debugf("retrieve container infos")
-	containers, err = instanceServer.GetContainersFull()
+	for name, containerInfo = range lxdInfo.Containers {
+		rpk = remoteProjectKey{Remote: containerInfo.Remote, Project: containerInfo.Project}
+		touchedRPKs[rpk] = true
+		op, err = putOp(containerKey(rpk, leafName(containerInfo.Location, containerInfo.Name)), containerInfo, leaseID)
+		if err != nil {
+			return err
+		}
+		ops = append(ops, op)
+		op, err = putOp(instanceKey(rpk, containerInfo.Type, leafName(containerInfo.Location, containerInfo.Name)), containerInfo, leaseID)
+		if err != nil {
+			return err
+		}
+		ops = append(ops, op)
+	}
+	// diff against the previous snapshot to explicitly delete objects that disappeared
+	if previous != nil {
+		for name, networkInfo = range previous.Networks {
+			if _, touched = lxdInfo.Networks[name]; touched {
+				continue
+			}
+			rpk = remoteProjectKey{Remote: networkInfo.Remote, Project: networkInfo.Project}
+			ops = append(ops, clientv3.OpDelete(networkKey(rpk, leafName(networkInfo.Location, networkInfo.Name))))
+		}
+		for name, containerInfo = range previous.Containers {
+			if _, touched = lxdInfo.Containers[name]; touched {
+				continue
+			}
+			rpk = remoteProjectKey{Remote: containerInfo.Remote, Project: containerInfo.Project}
+			ops = append(ops, clientv3.OpDelete(containerKey(rpk, leafName(containerInfo.Location, containerInfo.Name))))
+			ops = append(ops, clientv3.OpDelete(instanceKey(rpk, containerInfo.Type, leafName(containerInfo.Location, containerInfo.Name))))
+		}
+	}
+	for rpk = range touchedRPKs {
+		op, err = putOp(metaKey(rpk), MetaInfo{LastRefresh: time.Now(), Version: Version}, leaseID)
+		if err != nil {
+			return err
+		}
+		ops = append(ops, op)
+	}
+	return commitTxn(ctx, etcdClient, ops)
+}
+
+// getNetworkInfo reads and unmarshals the NetworkInfo stored at key in etcd, returning ok == false,
+// without an error, if the key does not exist.
+func getNetworkInfo(ctx context.Context, etcdClient *clientv3.Client, key string) (*NetworkInfo, bool, error) {
+	var (
+		err  error
+		resp *clientv3.GetResponse
+		info *NetworkInfo
+	)
+	resp, err = etcdClient.Get(ctx, key)
+	if err != nil {
+		return nil, false, stacktrace.Propagate(err, "fail to get key <%s> from etcd", key)
+	}
+	if len(resp.Kvs) == 0 {
+		return nil, false, nil
+	}
+	info = &NetworkInfo{}
+	err = json.Unmarshal(resp.Kvs[0].Value, info)
+	if err != nil {
+		return nil, false, stacktrace.Propagate(err, "fail to unmarshal value of key <%s>", key)
+	}
+	return info, true, nil
+}
+
+// getContainerInfo reads and unmarshals the ContainerInfo stored at key in etcd, returning
+// ok == false, without an error, if the key does not exist.
+func getContainerInfo(ctx context.Context, etcdClient *clientv3.Client, key string) (*ContainerInfo, bool, error) {
+	var (
+		err  error
+		resp *clientv3.GetResponse
+		info *ContainerInfo
+	)
+	resp, err = etcdClient.Get(ctx, key)
+	if err != nil {
+		return nil, false, stacktrace.Propagate(err, "fail to get key <%s> from etcd", key)
+	}
+	if len(resp.Kvs) == 0 {
+		return nil, false, nil
+	}
+	info = &ContainerInfo{}
+	err = json.Unmarshal(resp.Kvs[0].Value, info)
 	if err != nil {
-		return stacktrace.Propagate(err, "fail to retrieve containers")
-	}
-	for _, container = range containers {
-		loggo.GetLogger("").Tracef("processing container: <%#v>", container)
-		containerInfo = &ContainerInfo{}
-		containerInfo.Status = container.Status
-		// enrich with data from containers section of config
-		containersExtraData = config.GetContainers().Get(container.Name)
-		containerInfo.NodeIP = containersExtraData.NodeIP
-		containerInfo.DefaultInterface = containersExtraData.DefaultInterface
-		// fill network device info
-		containerInfo.NetDevs = make(map[string]*NetDev)
-		for netname, net = range container.State.Network {
-			loggo.GetLogger("").Tracef("processing container network <%s>: <%#v>", netname, net)
-			netdev = &NetDev{}
-			netdev.Network = container.ExpandedDevices[netname]["network"]
-			netdev.Port = net.HostName
-			netdev.MAC = net.Hwaddr
-			netdev.IPv4 = []string{}
-			netdev.IPv6 = []string{}
-			for _, instanceAddress = range net.Addresses {
-				loggo.GetLogger("").Tracef("processing net device address: <%#v>", instanceAddress)
-				if instanceAddress.Family == "inet" {
-					netdev.IPv4 = append(netdev.IPv4, fmt.Sprintf("%s/%s", instanceAddress.Address, instanceAddress.Netmask))
-				} else {
-					netdev.IPv6 = append(netdev.IPv6, fmt.Sprintf("%s/%s", instanceAddress.Address, instanceAddress.Netmask))
-				}
+		return nil, false, stacktrace.Propagate(err, "fail to unmarshal value of key <%s>", key)
+	}
+	return info, true, nil
+}
+
+// loadPreviousFromEtcd reconstructs an LxdInfo from the network and container entries currently
+// stored in etcd for every (remote, project) pair covered by sources. It is used as the "previous"
+// baseline for the first full reconcile after a (re)start, since the in-process cache (the other
+// source of "previous", see Service.lastLxdInfo) starts out empty on every restart: without reading
+// etcd's actual state back, an object deleted from LXD while lxd2etcd was down would never have its
+// stale etcd entry cleaned up.
+func loadPreviousFromEtcd(ctx context.Context, etcdClient *clientv3.Client, sources []RemoteSource) (*LxdInfo, error) {
+	var (
+		err           error
+		lxdInfo       *LxdInfo
+		rpks          map[remoteProjectKey]bool
+		source        RemoteSource
+		rpk           remoteProjectKey
+		resp          *clientv3.GetResponse
+		networkInfo   *NetworkInfo
+		containerInfo *ContainerInfo
+	)
+	lxdInfo = &LxdInfo{Networks: make(map[string]*NetworkInfo), Containers: make(map[string]*ContainerInfo)}
+	rpks = make(map[remoteProjectKey]bool)
+	for _, source = range sources {
+		rpks[remoteProjectKey{Remote: source.Remote, Project: source.Project}] = true
+	}
+	for rpk = range rpks {
+		resp, err = etcdClient.Get(ctx, networkKey(rpk, ""), clientv3.WithPrefix())
+		if err != nil {
+			return nil, stacktrace.Propagate(err, "fail to read existing network keys for remote <%s>, project <%s> from etcd", rpk.Remote, rpk.Project)
+		}
+		for _, kv := range resp.Kvs {
+			networkInfo = &NetworkInfo{}
+			err = json.Unmarshal(kv.Value, networkInfo)
+			if err != nil {
+				return nil, stacktrace.Propagate(err, "fail to unmarshal value of key <%s>", string(kv.Key))
 			}
-			containerInfo.NetDevs[netname] = netdev
-			// set default_ip
-			if netname == containersExtraData.DefaultInterface {
-				containerInfo.DefaultIPv4 = netdev.IPv4
-				containerInfo.DefaultIPv6 = netdev.IPv6
+			lxdInfo.Networks[objectKey(networkInfo.Remote, networkInfo.Location, networkInfo.Project, networkInfo.Name)] = networkInfo
+		}
+		resp, err = etcdClient.Get(ctx, containerKey(rpk, ""), clientv3.WithPrefix())
+		if err != nil {
+			return nil, stacktrace.Propagate(err, "fail to read existing container keys for remote <%s>, project <%s> from etcd", rpk.Remote, rpk.Project)
+		}
+		for _, kv := range resp.Kvs {
+			containerInfo = &ContainerInfo{}
+			err = json.Unmarshal(kv.Value, containerInfo)
+			if err != nil {
+				return nil, stacktrace.Propagate(err, "fail to unmarshal value of key <%s>", string(kv.Key))
 			}
+			lxdInfo.Containers[objectKey(containerInfo.Remote, containerInfo.Location, containerInfo.Project, containerInfo.Name)] = containerInfo
 		}
-		lxdInfo.Containers[container.Name] = containerInfo
 	}
-	return nil
+	return lxdInfo, nil
 }
 
-// Persist takes the data in the structure and store it into etcd
-func (lxdInfo *LxdInfo) Persist(ctx context.Context, etcdClient *clientv3.Client) error {
+// matchingSource returns the RemoteSource to query for a single object belonging to remote,
+// project and location. location is the cluster member the triggering event was received from (""
+// for a non-clustered remote); for a clustered remote every RemoteSource has a non-empty Location,
+// so matching on it is required to land on the cluster member that actually holds the object,
+// rather than an arbitrary one.
+func matchingSource(sources []RemoteSource, remote string, project string, location string) (RemoteSource, bool) {
 	var (
-		err     error
-		key     string
-		binJSON []byte
-		value   string
+		source RemoteSource
+		found  RemoteSource
+		ok     bool
+	)
+	for _, source = range sources {
+		if source.Remote != remote || source.Project != project {
+			continue
+		}
+		if source.Location != location {
+			continue
+		}
+		found = source
+		ok = true
+		break
+	}
+	return found, ok
+}
+
+// refreshNetwork re-queries (or, for a deletion action, removes) a single network's own etcd key,
+// along with its (remote, project)'s meta key, in one transaction.
+func refreshNetwork(ctx context.Context, etcdClient *clientv3.Client, source RemoteSource, req RefreshRequest, leaseID clientv3.LeaseID) error {
+	var (
+		err          error
+		rpk          remoteProjectKey
+		leaf         string
+		ops          []clientv3.Op
+		op           clientv3.Op
+		networkState *api.NetworkState
 	)
-	// Persist network infos
-	key = fmt.Sprintf("/lxd/%s/networks", config.GetHostname())
-	binJSON, err = json.Marshal(lxdInfo.Networks)
+	rpk = remoteProjectKey{Remote: req.Remote, Project: req.Project}
+	leaf = source.leafName(req.Name)
+	if req.Action == "network-deleted" {
+		ops = append(ops, clientv3.OpDelete(networkKey(rpk, leaf)))
+	} else {
+		networkState, err = source.InstanceServer.GetNetworkState(req.Name)
+		if err != nil {
+			return stacktrace.Propagate(err, "fail to retrieve state of network <%s> on remote <%s>", req.Name, req.Remote)
+		}
+		op, err = putOp(networkKey(rpk, leaf), buildNetworkInfo(source, req.Name, networkState), leaseID)
+		if err != nil {
+			return err
+		}
+		ops = append(ops, op)
+	}
+	op, err = putOp(metaKey(rpk), MetaInfo{LastRefresh: time.Now(), Version: Version}, leaseID)
 	if err != nil {
-		return stacktrace.Propagate(err, "fail to serialize <%#v>", lxdInfo.Networks)
+		return err
 	}
-	value = string(binJSON)
-	_, err = etcdClient.Put(ctx, key, value)
+	ops = append(ops, op)
+	return commitTxn(ctx, etcdClient, ops)
+}
+
+// refreshInstance re-queries (or, for a deletion action, removes) a single instance's own etcd
+// keys (the flat "containers" compatibility entry and the "instances/<type>" entry), along with
+// its (remote, project)'s meta key, in one transaction.
+func refreshInstance(ctx context.Context, etcdClient *clientv3.Client, source RemoteSource, req RefreshRequest, leaseID clientv3.LeaseID) error {
+	var (
+		err           error
+		rpk           remoteProjectKey
+		leaf          string
+		containersKey string
+		existing      *ContainerInfo
+		ok            bool
+		ops           []clientv3.Op
+		op            clientv3.Op
+		instance      *api.Instance
+		state         *api.InstanceState
+		containerInfo *ContainerInfo
+	)
+	rpk = remoteProjectKey{Remote: req.Remote, Project: req.Project}
+	leaf = source.leafName(req.Name)
+	containersKey = containerKey(rpk, leaf)
+	existing, ok, err = getContainerInfo(ctx, etcdClient, containersKey)
 	if err != nil {
-		return stacktrace.Propagate(err, "fail to put key <%s> in etcd", key)
+		return err
 	}
-	// Persist container infos
-	key = fmt.Sprintf("/lxd/%s/containers", config.GetHostname())
-	binJSON, err = json.Marshal(lxdInfo.Containers)
+	if req.Action == "instance-deleted" || req.Action == "virtual-machine-deleted" {
+		ops = append(ops, clientv3.OpDelete(containersKey))
+		if ok {
+			ops = append(ops, clientv3.OpDelete(instanceKey(rpk, existing.Type, leaf)))
+		}
+		op, err = putOp(metaKey(rpk), MetaInfo{LastRefresh: time.Now(), Version: Version}, leaseID)
+		if err != nil {
+			return err
+		}
+		ops = append(ops, op)
+		return commitTxn(ctx, etcdClient, ops)
+	}
+	instance, _, err = source.InstanceServer.GetInstance(req.Name)
+	if err != nil {
+		return stacktrace.Propagate(err, "fail to retrieve instance <%s> on remote <%s>", req.Name, req.Remote)
+	}
+	state, _, err = source.InstanceServer.GetInstanceState(req.Name)
+	if err != nil {
+		return stacktrace.Propagate(err, "fail to retrieve state of instance <%s> on remote <%s>", req.Name, req.Remote)
+	}
+	containerInfo = buildContainerInfo(log.New("remote", req.Remote, "container", instance.Name), source, instance.Name, instance.Type, instance.Status, instance.ExpandedDevices, state)
+	// the instance may have changed type (container <-> virtual-machine) since the last refresh
+	if ok && existing.Type != containerInfo.Type {
+		ops = append(ops, clientv3.OpDelete(instanceKey(rpk, existing.Type, leaf)))
+	}
+	op, err = putOp(containersKey, containerInfo, leaseID)
+	if err != nil {
+		return err
+	}
+	ops = append(ops, op)
+	op, err = putOp(instanceKey(rpk, containerInfo.Type, leaf), containerInfo, leaseID)
+	if err != nil {
+		return err
+	}
+	ops = append(ops, op)
+	op, err = putOp(metaKey(rpk), MetaInfo{LastRefresh: time.Now(), Version: Version}, leaseID)
 	if err != nil {
-		return stacktrace.Propagate(err, "fail to serialize <%#v>", lxdInfo.Containers)
+		return err
+	}
+	ops = append(ops, op)
+	return commitTxn(ctx, etcdClient, ops)
+}
+
+// RefreshOne re-queries (or removes) the single instance or network described by req and updates
+// its etcd entry, without re-reading the whole inventory. sources is used to find the
+// RemoteSource to query against. leaseID is the lease (or clientv3.NoLease) to attach written keys
+// to.
+func RefreshOne(ctx context.Context, etcdClient *clientv3.Client, sources []RemoteSource, req RefreshRequest, leaseID clientv3.LeaseID) error {
+	var (
+		err    error
+		source RemoteSource
+		ok     bool
+	)
+	source, ok = matchingSource(sources, req.Remote, req.Project, req.Location)
+	if !ok {
+		log.New("remote", req.Remote, "project", req.Project, "location", req.Location).Tracef("no known source, ignoring refresh request")
+		return nil
+	}
+	switch req.Kind {
+	case "instance":
+		err = refreshInstance(ctx, etcdClient, source, req, leaseID)
+	case "network":
+		err = refreshNetwork(ctx, etcdClient, source, req, leaseID)
+	default:
+		return stacktrace.NewError("unknown refresh request kind <%s>", req.Kind)
 	}
-	value = string(binJSON)
-	_, err = etcdClient.Put(ctx, key, value)
 	if err != nil {
-		return stacktrace.Propagate(err, "fail to put key <%s> in etcd", key)
+		return stacktrace.Propagate(err, "fail to refresh <%s> <%s> on remote <%s>", req.Kind, req.Name, req.Remote)
 	}
 	return nil
 }
@@ -166,7 +652,7 @@ func (lxdInfo *LxdInfo) PrettyString() string {
 	)
 	b, err = json.Marshal(lxdInfo)
 	if err != nil {
-		loggo.GetLogger("").Errorf(stacktrace.Propagate(err, "fail to compute pretty string for <%#v>", lxdInfo).Error())
+		log.New().Errorf(stacktrace.Propagate(err, "fail to compute pretty string for <%#v>", lxdInfo).Error())
 		return fmt.Sprintf("fail to compute pretty string for <%#v>", lxdInfo)
 	}
 	json.Indent(&out, b, "", "  ")
@@ -0,0 +1,71 @@
+package lxd2etcd
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Prometheus collectors exposed on the admin HTTP server's /metrics endpoint. They are package
+// level so that every part of lxd2etcd (event handling, populate, etcd writes) can report to them
+// without threading a metrics object through every call.
+var (
+	eventsReceivedTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "lxd2etcd_events_received_total",
+		Help: "Number of LXD events received, by action.",
+	}, []string{"action"})
+
+	refreshesTriggeredTotal = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "lxd2etcd_refreshes_triggered_total",
+		Help: "Number of incremental refresh requests triggered by LXD events.",
+	})
+
+	etcdPutsTotal = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "lxd2etcd_etcd_puts_total",
+		Help: "Number of etcd put operations performed.",
+	})
+
+	etcdDeletesTotal = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "lxd2etcd_etcd_deletes_total",
+		Help: "Number of etcd delete operations performed.",
+	})
+
+	errorsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "lxd2etcd_errors_total",
+		Help: "Number of errors encountered, by component.",
+	}, []string{"component"})
+
+	populateDurationSeconds = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Name:    "lxd2etcd_populate_duration_seconds",
+		Help:    "Duration of a full LXD inventory populate.",
+		Buckets: prometheus.DefBuckets,
+	})
+
+	etcdWriteLatencySeconds = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Name:    "lxd2etcd_etcd_write_latency_seconds",
+		Help:    "Latency of etcd write transactions (puts and deletes).",
+		Buckets: prometheus.DefBuckets,
+	})
+
+	trackedInstancesGauge = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "lxd2etcd_tracked_instances",
+		Help: "Number of instances (containers and virtual-machines) currently tracked.",
+	})
+
+	trackedNetworksGauge = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "lxd2etcd_tracked_networks",
+		Help: "Number of networks currently tracked.",
+	})
+)
+
+func init() {
+	prometheus.MustRegister(
+		eventsReceivedTotal,
+		refreshesTriggeredTotal,
+		etcdPutsTotal,
+		etcdDeletesTotal,
+		errorsTotal,
+		populateDurationSeconds,
+		etcdWriteLatencySeconds,
+		trackedInstancesGauge,
+		trackedNetworksGauge,
+	)
+}
@@ -2,9 +2,12 @@ package lxd2etcd
 
 import (
 	"context"
+	"os"
+	"sync"
 	"time"
 
 	"github.com/limhud/lxd2etcd/internal/config"
+	"github.com/limhud/lxd2etcd/internal/log"
 
 	"github.com/juju/loggo"
 	lxd "github.com/lxc/lxd/client"
@@ -13,265 +16,339 @@ import (
 	"go.etcd.io/etcd/clientv3"
 )
 
+// Version is the running lxd2etcd build version, set by main via ldflags. LxdInfo.Persist
+// publishes it in every "meta" key it writes, so that consumers can tell which agent version last
+// refreshed a given prefix.
+var Version string
+
 // Service represents a service struct.
 type Service struct {
-	initialized       bool
-	lxdInstanceServer lxd.InstanceServer
-	lxdEventListener  *lxd.EventListener
-	etcdClient        *clientv3.Client
-	errorChan         chan error
-	refreshChan       chan struct{}
+	remoteSources []RemoteSource
+	etcdClient    *clientv3.Client
+	leaseID       clientv3.LeaseID
+	errorChan     chan error
+	refreshChan   chan RefreshRequest
+	triggerChan   chan struct{}
+	dhcpResetChan chan struct{}
+	cancel        context.CancelFunc
+	adminServer   *AdminServer
+	stateLock     sync.RWMutex
+	lxdConnected  bool
+	etcdConnected bool
+	ready         bool
+	lastPopulated *LxdInfo
+	eventIdle     *eventIdleTracker
 }
 
 // NewService returns a new service instance.
 func NewService() (*Service, error) {
 	service := &Service{}
-	service.initialized = false
 	service.errorChan = make(chan error)
-	service.refreshChan = make(chan struct{}, 1000)
+	service.refreshChan = make(chan RefreshRequest, 1000)
+	service.triggerChan = make(chan struct{}, 1)
+	service.dhcpResetChan = make(chan struct{}, 1)
 	return service, nil
 }
 
-func initServiceWithRetries(ctx context.Context, service *Service) {
+// setLxdConnected records whether the lxd-listener sub-service is currently connected to all
+// configured LXD remotes. It is read by the admin HTTP server's /healthz handler, from a
+// different goroutine than the one running the sub-service, hence the lock.
+func (service *Service) setLxdConnected(connected bool) {
+	service.stateLock.Lock()
+	defer service.stateLock.Unlock()
+	service.lxdConnected = connected
+}
+
+// setEtcdConnected records whether the etcd-persister sub-service is currently connected to etcd.
+func (service *Service) setEtcdConnected(connected bool) {
+	service.stateLock.Lock()
+	defer service.stateLock.Unlock()
+	service.etcdConnected = connected
+}
+
+// isHealthy returns true if the service is currently connected to both LXD and etcd.
+func (service *Service) isHealthy() bool {
+	service.stateLock.RLock()
+	defer service.stateLock.RUnlock()
+	return service.lxdConnected && service.etcdConnected
+}
+
+// setLastPopulated records the most recently populated inventory, marking the service ready. It is
+// read by the admin HTTP server's /readyz and /debug/state handlers, from a different goroutine
+// than the one running Start.
+func (service *Service) setLastPopulated(lxdInfo *LxdInfo) {
+	service.stateLock.Lock()
+	defer service.stateLock.Unlock()
+	service.lastPopulated = lxdInfo
+	service.ready = true
+}
+
+// isReady returns true once the service has completed at least one full populate/persist cycle.
+func (service *Service) isReady() bool {
+	service.stateLock.RLock()
+	defer service.stateLock.RUnlock()
+	return service.ready
+}
+
+// lastLxdInfo returns the most recently populated inventory, or nil if none has been populated yet.
+func (service *Service) lastLxdInfo() *LxdInfo {
+	service.stateLock.RLock()
+	defer service.stateLock.RUnlock()
+	return service.lastPopulated
+}
+
+// setRemoteSources records the lxd-listener sub-service's current set of sources. It is read by
+// the etcd-persister sub-service, from a different goroutine, hence the lock.
+func (service *Service) setRemoteSources(sources []RemoteSource) {
+	service.stateLock.Lock()
+	defer service.stateLock.Unlock()
+	service.remoteSources = sources
+}
+
+// getRemoteSources returns the lxd-listener sub-service's current set of sources.
+func (service *Service) getRemoteSources() []RemoteSource {
+	service.stateLock.RLock()
+	defer service.stateLock.RUnlock()
+	return service.remoteSources
+}
+
+// setEventIdleTracker records the lxd-listener sub-service's current event idle tracker, replaced
+// on every (re)connection.
+func (service *Service) setEventIdleTracker(tracker *eventIdleTracker) {
+	service.stateLock.Lock()
+	defer service.stateLock.Unlock()
+	service.eventIdle = tracker
+}
+
+// eventIdleDuration returns how long it has been since the last LXD event was received, or 0 if no
+// tracker has been installed yet (the lxd-listener sub-service has not connected yet). It is read
+// by the admin HTTP server, from a different goroutine than the one running the sub-service.
+func (service *Service) eventIdleDuration() time.Duration {
+	service.stateLock.RLock()
+	tracker := service.eventIdle
+	service.stateLock.RUnlock()
+	if tracker == nil {
+		return 0
+	}
+	return tracker.idleFor()
+}
+
+// refreshKey identifies a single LXD object, used to coalesce pending RefreshRequests received
+// for the same object while a debounce window is running.
+type refreshKey struct {
+	Remote   string
+	Location string
+	Project  string
+	Kind     string
+	Name     string
+}
+
+// connectRemote dials a single configured remote, returning the InstanceServer to use as the
+// "default" target for that remote (the cluster leader's view, for a clustered HTTPS remote).
+func connectRemote(remote config.RemoteConfig) (lxd.InstanceServer, error) {
 	var (
-		err      error
-		wait     time.Duration
-		errChan  chan error
-		inChan   chan *Service
-		doneChan chan struct{}
-		timer    *time.Timer
+		err            error
+		instanceServer lxd.InstanceServer
+		clientCert     []byte
+		clientKey      []byte
+		ca             []byte
 	)
-	service.initialized = false
-	wait = 0
-	errChan = make(chan error)
-	inChan = make(chan *Service)
-	doneChan = make(chan struct{})
-	loggo.GetLogger("").Tracef("starting to initialize service with retries")
-	for {
-		go func() {
-			var (
-				err                 error
-				serviceToInitialize *Service
-			)
-			select {
-			case <-ctx.Done():
-				return
-			case serviceToInitialize = <-inChan:
-				err = serviceToInitialize.init(ctx)
-				if err != nil {
-					loggo.GetLogger("").Tracef("intialization error")
-					errChan <- stacktrace.Propagate(err, "fail to initialize service")
-					return
-				}
-				doneChan <- struct{}{}
+	if remote.IsHTTPS() {
+		clientCert, err = os.ReadFile(remote.ClientCert)
+		if err != nil {
+			return nil, stacktrace.Propagate(err, "fail to read client certificate <%s> for remote <%s>", remote.ClientCert, remote.Name)
+		}
+		clientKey, err = os.ReadFile(remote.ClientKey)
+		if err != nil {
+			return nil, stacktrace.Propagate(err, "fail to read client key <%s> for remote <%s>", remote.ClientKey, remote.Name)
+		}
+		if remote.CA != "" {
+			ca, err = os.ReadFile(remote.CA)
+			if err != nil {
+				return nil, stacktrace.Propagate(err, "fail to read CA <%s> for remote <%s>", remote.CA, remote.Name)
 			}
-		}()
-		inChan <- service
-		select {
-		case <-ctx.Done():
-			loggo.GetLogger("").Tracef("initialization canceled")
-			return
-		case <-doneChan:
-			service.initialized = true
-			loggo.GetLogger("").Debugf("service initialized")
-			loggo.GetLogger("").Tracef("service: <%#v>", service)
-			return
-		case err = <-errChan:
-			loggo.GetLogger("").Errorf(err.Error())
 		}
-		timer = time.NewTimer(wait * time.Second)
-		select {
-		case <-ctx.Done():
-			loggo.GetLogger("").Tracef("initialization canceled")
-			return
-		case <-timer.C:
-			loggo.GetLogger("").Tracef("trying again to initialize service")
-			if wait < 60 {
-				wait = wait + 10
+		instanceServer, err = lxd.ConnectLXD(remote.URL, &lxd.ConnectionArgs{
+			TLSClientCert: string(clientCert),
+			TLSClientKey:  string(clientKey),
+			TLSCA:         string(ca),
+		})
+		if err != nil {
+			return nil, stacktrace.Propagate(err, "fail to connect to https remote <%s>", remote.Name)
+		}
+	} else {
+		instanceServer, err = lxd.ConnectLXDUnix(remote.Socket, nil)
+		if err != nil {
+			return nil, stacktrace.Propagate(err, "fail to connect to unix socket remote <%s>", remote.Name)
+		}
+	}
+	return instanceServer, nil
+}
+
+// remoteSources expands a single remote into one RemoteSource per cluster member (for a
+// clustered HTTPS remote) or a single RemoteSource (unix socket remote, or a non-clustered
+// HTTPS remote).
+func remoteSources(remote config.RemoteConfig, instanceServer lxd.InstanceServer) ([]RemoteSource, error) {
+	var (
+		err     error
+		members []api.ClusterMember
+		member  api.ClusterMember
+		sources []RemoteSource
+	)
+	if remote.IsHTTPS() {
+		members, err = instanceServer.GetClusterMembers()
+		if err == nil && len(members) > 0 {
+			for _, member = range members {
+				sources = append(sources, RemoteSource{
+					Remote:         remote.Name,
+					Location:       member.ServerName,
+					InstanceServer: instanceServer.UseTarget(member.ServerName),
+				})
 			}
+			return sources, nil
 		}
+		log.New("remote", remote.Name).Tracef("remote is not a cluster, following it as a single node")
 	}
+	return []RemoteSource{{Remote: remote.Name, InstanceServer: instanceServer}}, nil
 }
 
-func (service *Service) init(ctx context.Context) error {
+// projectsToFollow returns the projects configured for a remote, defaulting to the "default"
+// project when none is set.
+func projectsToFollow(remote config.RemoteConfig) []string {
+	if len(remote.Projects) == 0 {
+		return []string{"default"}
+	}
+	return remote.Projects
+}
+
+// grantLease grants a lease for config.GetEtcd().LeaseTTL and keeps it alive for the lifetime of
+// ctx, so that the keys written under it self-expire if the process dies without a clean shutdown.
+// It returns clientv3.NoLease, without granting anything, when LeaseTTL is <= 0. If the keepalive
+// stream ends for any reason other than ctx being done (eg the lease actually expired because etcd
+// was unreachable for longer than the TTL), a signal is sent on keepAliveFailedChan so the caller can
+// tear down the etcd client and reconnect, rather than keep writing under a lease etcd no longer
+// honors.
+func grantLease(ctx context.Context, etcdClient *clientv3.Client, keepAliveFailedChan chan<- struct{}) (clientv3.LeaseID, error) {
 	var (
-		err        error
-		eventName  string
-		etcdConfig clientv3.Config
+		err           error
+		leaseTTL      time.Duration
+		grantResp     *clientv3.LeaseGrantResponse
+		keepAliveChan <-chan *clientv3.LeaseKeepAliveResponse
 	)
-	loggo.GetLogger("").Tracef("initializing service")
-	// initialize lxd listener
-	service.lxdInstanceServer, err = lxd.ConnectLXDUnix(config.GetLxd().Socket, nil)
-	if err != nil {
-		return stacktrace.Propagate(err, "fail to initialize lxd client")
+	leaseTTL = config.GetEtcd().LeaseTTL
+	if leaseTTL <= 0 {
+		return clientv3.NoLease, nil
 	}
-	loggo.GetLogger("").Debugf("lxd client initialized")
-	service.lxdEventListener, err = service.lxdInstanceServer.GetEventsAllProjects()
+	grantResp, err = etcdClient.Grant(ctx, int64(leaseTTL.Seconds()))
 	if err != nil {
-		return stacktrace.Propagate(err, "fail to initialize lxd event listener")
+		return clientv3.NoLease, stacktrace.Propagate(err, "fail to grant etcd lease with ttl <%s>", leaseTTL)
 	}
-	// initialize lxd listener handler
-	_, err = service.lxdEventListener.AddHandler([]string{"lifecycle"}, func(event api.Event) {
-		var (
-			err error
-		)
-		loggo.GetLogger("").Tracef("event <%s>: <%s>", eventName, LxdEventToString(event))
-		err = HandleLxdEvent(service.refreshChan, event)
-		if err != nil {
-			service.errorChan <- err
-		}
-	})
+	keepAliveChan, err = etcdClient.KeepAlive(ctx, grantResp.ID)
 	if err != nil {
-		return stacktrace.Propagate(err, "fail to add event handler for <lifecycle> event type")
+		return clientv3.NoLease, stacktrace.Propagate(err, "fail to start keepalive for etcd lease <%x>", grantResp.ID)
 	}
-	loggo.GetLogger("").Debugf("lxd event handlers installed")
-	// initialize etcd client
-	etcdConfig = clientv3.Config{
-		Endpoints:   config.GetEtcd().Endpoints,
-		DialTimeout: config.GetEtcd().DialTimeout,
-		Username:    config.GetEtcd().Username,
-		Password:    config.GetEtcd().Password,
-		Context:     ctx,
+	go func() {
+		for range keepAliveChan {
+			// drain keepalive responses; nothing to do on each successful renewal
+		}
+		if ctx.Err() != nil {
+			log.New("lease", grantResp.ID).Tracef("etcd lease keepalive stopped")
+			return
+		}
+		log.New("lease", grantResp.ID).Warningf("etcd lease keepalive failed, lease <%x> is presumed lost", grantResp.ID)
+		select {
+		case keepAliveFailedChan <- struct{}{}:
+		default: // a failure is already pending, no need to queue another one
+		}
+	}()
+	log.New("lease", grantResp.ID).Debugf("etcd lease granted with ttl <%s>", leaseTTL)
+	return grantResp.ID, nil
+}
+
+// revokeLease revokes leaseID, if any (a no-op if leases are disabled, ie leaseID is
+// clientv3.NoLease), so that every key attached to it disappears from etcd immediately instead of
+// waiting out the remainder of its TTL. It is called on a clean shutdown (SIGINT/SIGTERM), so that
+// consumers watching this node's prefix see it disappear right away. It uses its own background
+// context since ctx, the one grantLease was called with, is already cancelled by the time Shutdown
+// runs.
+func revokeLease(etcdClient *clientv3.Client, leaseID clientv3.LeaseID) {
+	var err error
+	if leaseID == clientv3.NoLease {
+		return
 	}
-	loggo.GetLogger("").Debugf("etcd config: <%#v>", etcdConfig)
-	service.etcdClient, err = clientv3.New(etcdConfig)
+	_, err = etcdClient.Revoke(context.Background(), leaseID)
 	if err != nil {
-		return stacktrace.Propagate(err, "fail to initialize etcd client with config <%#v>", etcdConfig)
+		log.New("lease", leaseID).Errorf(stacktrace.Propagate(err, "fail to revoke etcd lease <%x> on shutdown", leaseID).Error())
+		return
 	}
-	loggo.GetLogger("").Debugf("etcd client initialized")
-	return nil
+	log.New("lease", leaseID).Debugf("etcd lease revoked")
 }
 
-func (service *Service) disconnect() {
-	var (
-		err error
-	)
-	// disconnect from lxd
-	if service.lxdEventListener != nil && service.lxdEventListener.IsActive() {
-		service.lxdEventListener.Disconnect()
+// Shutdown stops the running service's sub-services and, if enabled, its admin HTTP server. It is
+// safe to call even if Start has not been called yet or has already returned.
+func (service *Service) Shutdown() error {
+	if service.cancel != nil {
+		service.cancel()
 	}
-	// disconnect from etcd
-	if service.etcdClient != nil && service.etcdClient.ActiveConnection() != nil {
-		err = service.etcdClient.Close()
-		if err != nil {
-			loggo.GetLogger("").Errorf(stacktrace.Propagate(err, "fail to close etcd client").Error())
-		}
+	if service.adminServer != nil {
+		return service.adminServer.Shutdown(context.Background())
 	}
+	return nil
 }
 
 // ToggleDebug toggles log levele between DEBUG and INFO.
 func (service *Service) ToggleDebug() {
 	if loggo.GetLogger("").LogLevel() == loggo.INFO {
-		loggo.GetLogger("").Infof("setting log level to Debug")
+		log.New().Infof("setting log level to Debug")
 		loggo.GetLogger("").SetLogLevel(loggo.DEBUG)
 	} else if loggo.GetLogger("").LogLevel() == loggo.DEBUG {
-		loggo.GetLogger("").Infof("setting log level to Trace")
+		log.New().Infof("setting log level to Trace")
 		loggo.GetLogger("").SetLogLevel(loggo.TRACE)
 	} else {
-		loggo.GetLogger("").Infof("setting log level to Info")
+		log.New().Infof("setting log level to Info")
 		loggo.GetLogger("").SetLogLevel(loggo.INFO)
 	}
 }
 
-// Start the service.
-func (service *Service) Start(ctx context.Context) error {
+// Start the service: launches its sub-services under supervision and blocks until ctx is
+// cancelled. Each sub-service is restarted independently, with exponential backoff, whenever it
+// fails, so that eg an etcd reconnection does not interrupt the LXD event listener.
+func (service *Service) Start(parentCtx context.Context) error {
 	var (
-		err                   error
-		lxdInfo               *LxdInfo
-		processingTriggerChan chan struct{}
-		ticker                *time.Ticker
-		emptyChanTimer        *time.Timer
-		waitForDHCPTimer      *time.Timer
+		ctx  context.Context
+		wg   sync.WaitGroup
+		subs []SubService
+		sub  SubService
 	)
-	processingTriggerChan = make(chan struct{}, 1)
-	ticker = time.NewTicker(config.GetLxd().PeriodicRefresh)
-	defer ticker.Stop()
-	emptyChanTimer = time.NewTimer(time.Second)
-	defer emptyChanTimer.Stop()
-	waitForDHCPTimer = time.AfterFunc(config.GetLxd().WaitForDHCP, func() {
-		select {
-		case processingTriggerChan <- struct{}{}:
-			loggo.GetLogger("").Infof("refresh triggered by automatic wait for dhcp")
-		default: // chan is already full, no need to trigger refresh
-			loggo.GetLogger("").Tracef("automatic wait for dhcp cancelled because chan is already full")
-		}
-	})
-	waitForDHCPTimer.Stop()
-	defer waitForDHCPTimer.Stop()
-ServiceLoop:
-	for {
-		initServiceWithRetries(ctx, service)
-		// trigger initial refresh
-		processingTriggerChan <- struct{}{}
-	RefreshLoop:
-		for {
-			loggo.GetLogger("").Tracef("waiting for refresh")
-			select {
-			case <-ctx.Done():
-				loggo.GetLogger("").Infof("stopping service...")
-				break ServiceLoop
-			case <-ticker.C:
-				select {
-				case processingTriggerChan <- struct{}{}:
-					loggo.GetLogger("").Infof("refresh triggered by ticker")
-				default:
-					loggo.GetLogger("").Tracef("ticker refresh cancelled because chan is already full")
-					// chan is already full, do not block.
-				}
-			case <-service.refreshChan:
-				// empty refreshChan
-				if !emptyChanTimer.Stop() {
-					<-emptyChanTimer.C
-				}
-				emptyChanTimer.Reset(time.Second) // start timer limiting the time for flushing events
-			EmptyChanLoop:
-				for {
-					select {
-					case <-service.refreshChan:
-					case <-emptyChanTimer.C: // too much time flushing events
-						loggo.GetLogger("").Tracef("too much time flushing events, stopping here.")
-						break EmptyChanLoop
-					default: // no more event to flush
-						break EmptyChanLoop
-					}
-				}
-				// non blocking send
-				select {
-				case processingTriggerChan <- struct{}{}:
-				default:
-					// chan is already full meaning a refresh is already pending, so we do not need to append a new refresh.
-				}
-				loggo.GetLogger("").Infof("refresh triggered by event")
-				waitForDHCPTimer.Reset(config.GetLxd().WaitForDHCP)
-			case <-processingTriggerChan:
-				if !service.initialized {
-					loggo.GetLogger("").Warningf("cancelling triggered processing before service initialization")
-					continue
-				}
-				loggo.GetLogger("").Tracef("processing refresh")
-				lxdInfo = &LxdInfo{}
-				err = lxdInfo.Populate(service.lxdInstanceServer)
-				if err != nil {
-					loggo.GetLogger("").Errorf(stacktrace.Propagate(err, "fail to obtain lxd infos").Error())
-					service.disconnect()
-					break RefreshLoop
-				}
-				loggo.GetLogger("").Debugf("retrieved lxd info:\n%s", lxdInfo.PrettyString())
-				err = lxdInfo.Persist(ctx, service.etcdClient)
-				if err != nil {
-					loggo.GetLogger("").Errorf(stacktrace.Propagate(err, "fail to persist data to etcd").Error())
-					service.disconnect()
-					break RefreshLoop
-				}
-				loggo.GetLogger("").Infof("etcd updated")
-			case err = <-service.errorChan:
-				service.disconnect()
-				loggo.GetLogger("").Errorf(err.Error())
-				break RefreshLoop
-			}
+	ctx, service.cancel = context.WithCancel(parentCtx)
+	defer service.cancel()
+	service.adminServer = NewAdminServer(service)
+	if service.adminServer != nil {
+		service.adminServer.Start(service.errorChan)
+	}
+	go func() {
+		var err error
+		for err = range service.errorChan {
+			log.New().Errorf(err.Error())
 		}
+	}()
+	subs = []SubService{
+		&lxdListenerService{service: service},
+		&periodicRefreshService{service: service},
+		&waitForDHCPService{service: service},
+		&etcdPersisterService{service: service},
 	}
-	service.disconnect()
-	loggo.GetLogger("").Infof("service has been stopped...")
-	return err
+	for _, sub = range subs {
+		wg.Add(1)
+		go func(sub SubService) {
+			defer wg.Done()
+			service.supervise(ctx, sub)
+		}(sub)
+	}
+	log.New().Infof("service started")
+	<-ctx.Done()
+	log.New().Infof("stopping service...")
+	wg.Wait()
+	log.New().Infof("service has been stopped...")
+	return nil
 }
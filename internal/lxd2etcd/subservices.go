@@ -0,0 +1,453 @@
+package lxd2etcd
+
+import (
+	"context"
+	"time"
+
+	"github.com/limhud/lxd2etcd/internal/config"
+	"github.com/limhud/lxd2etcd/internal/log"
+
+	lxd "github.com/lxc/lxd/client"
+	"github.com/lxc/lxd/shared/api"
+	"github.com/palantir/stacktrace"
+	"go.etcd.io/etcd/clientv3"
+)
+
+// SubService is a single independently-restartable component of Service. This mirrors the
+// pattern used by syncthing's util services.
+type SubService interface {
+	// Name identifies the sub-service in logs.
+	Name() string
+	// Serve runs the sub-service until ctx is cancelled, or until it fails. It must return
+	// promptly once ctx is done.
+	Serve(ctx context.Context) error
+}
+
+// supervise runs sub until ctx is cancelled, restarting it with an exponential backoff (capped at
+// 60s, reset whenever ctx is cancelled) whenever it returns, whether due to an error or not. This
+// lets a single failed sub-service (eg a dropped etcd connection) recover on its own, without
+// tearing down the others. Every line it logs is tagged with the sub-service's name.
+func (service *Service) supervise(ctx context.Context, sub SubService) {
+	var (
+		err  error
+		wait time.Duration
+		lg   log.Logger
+	)
+	lg = log.New("subservice", sub.Name())
+	for {
+		lg.Debugf("starting sub-service")
+		err = sub.Serve(ctx)
+		if ctx.Err() != nil {
+			lg.Tracef("sub-service stopped")
+			return
+		}
+		if err != nil {
+			lg.Errorf(stacktrace.Propagate(err, "sub-service failed").Error())
+		} else {
+			lg.Warningf("sub-service exited unexpectedly, restarting")
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(wait):
+		}
+		if wait == 0 {
+			wait = 10 * time.Second
+		} else {
+			wait *= 2
+		}
+		if wait > 60*time.Second {
+			wait = 60 * time.Second
+		}
+	}
+}
+
+// lxdListenerService connects to every configured LXD remote, builds the list of RemoteSources to
+// follow and installs a lifecycle event handler on each remote, pushing a RefreshRequest onto
+// service.refreshChan for every relevant event. It runs until ctx is cancelled, one of its event
+// handlers reports an unrecoverable error, or the liveness probe sent after MaxEventIdle without
+// events fails.
+type lxdListenerService struct {
+	service *Service
+}
+
+// Name identifies the sub-service in logs.
+func (sub *lxdListenerService) Name() string {
+	return "lxd-listener"
+}
+
+// Serve implements SubService.
+func (sub *lxdListenerService) Serve(ctx context.Context) error {
+	var (
+		err             error
+		lg              log.Logger
+		remote          config.RemoteConfig
+		remoteLg        log.Logger
+		instanceServer  lxd.InstanceServer
+		locationSources []RemoteSource
+		locationSource  RemoteSource
+		project         string
+		listener        *lxd.EventListener
+		listeners       map[string][]*lxd.EventListener
+		instanceServers map[string]lxd.InstanceServer
+		sources         []RemoteSource
+		handlerErrChan  chan error
+		idleTracker     *eventIdleTracker
+		idleCheckTicker *time.Ticker
+	)
+	lg = log.New("subservice", sub.Name())
+	sub.service.setLxdConnected(false)
+	listeners = make(map[string][]*lxd.EventListener)
+	instanceServers = make(map[string]lxd.InstanceServer)
+	handlerErrChan = make(chan error, 1)
+	idleTracker = newEventIdleTracker()
+	defer func() {
+		sub.service.setLxdConnected(false)
+		sub.service.setEventIdleTracker(nil)
+		for _, remoteListeners := range listeners {
+			for _, listener = range remoteListeners {
+				if listener != nil && listener.IsActive() {
+					listener.Disconnect()
+				}
+			}
+		}
+	}()
+	for _, remote = range config.GetLxd().Remotes {
+		remoteLg = lg.With("remote", remote.Name)
+		instanceServer, err = connectRemote(remote)
+		if err != nil {
+			return stacktrace.Propagate(err, "fail to initialize lxd client for remote <%s>", remote.Name)
+		}
+		remoteLg.Debugf("lxd client initialized")
+		instanceServers[remote.Name] = instanceServer
+		locationSources, err = remoteSources(remote, instanceServer)
+		if err != nil {
+			return stacktrace.Propagate(err, "fail to enumerate cluster members for remote <%s>", remote.Name)
+		}
+		for _, locationSource = range locationSources {
+			for _, project = range projectsToFollow(remote) {
+				if !config.GetProjects().IsAllowed(project) {
+					remoteLg.Debugf("project <%s> is not allowed, skipping", project)
+					continue
+				}
+				sources = append(sources, RemoteSource{
+					Remote:         locationSource.Remote,
+					Location:       locationSource.Location,
+					Project:        project,
+					InstanceServer: locationSource.InstanceServer.UseProject(project),
+				})
+			}
+		}
+		// One event listener is opened per (remote, project): the pinned lxc/lxd client version
+		// does not expose the project an event belongs to on api.Event itself, so the project the
+		// handler should use is instead carried by the listener's own connection, scoped with
+		// InstanceServer.UseProject (which also makes LXD filter the event stream server-side, to
+		// just that project).
+		for _, project = range projectsToFollow(remote) {
+			if !config.GetProjects().IsAllowed(project) {
+				continue
+			}
+			listener, err = instanceServer.UseProject(project).GetEvents()
+			if err != nil {
+				return stacktrace.Propagate(err, "fail to initialize lxd event listener for remote <%s>, project <%s>", remote.Name, project)
+			}
+			_, err = listener.AddHandler([]string{"lifecycle"}, func(remoteName string, projectName string) func(api.Event) {
+				return func(event api.Event) {
+					var err error
+					idleTracker.touch()
+					log.New("remote", remoteName, "project", projectName).Tracef("event: <%s>", LxdEventToString(event))
+					err = HandleLxdEvent(sub.service.refreshChan, remoteName, projectName, event)
+					if err != nil {
+						select {
+						case handlerErrChan <- err:
+						default: // a failure is already pending, no need to queue another one
+						}
+					}
+				}
+			}(remote.Name, project))
+			if err != nil {
+				return stacktrace.Propagate(err, "fail to add event handler for <lifecycle> event type on remote <%s>, project <%s>", remote.Name, project)
+			}
+			listeners[remote.Name] = append(listeners[remote.Name], listener)
+		}
+	}
+	sub.service.setRemoteSources(sources)
+	sub.service.setLxdConnected(true)
+	idleTracker.touch()
+	sub.service.setEventIdleTracker(idleTracker)
+	lg.Debugf("lxd event handlers installed")
+	if config.GetLxd().MaxEventIdle <= 0 {
+		select {
+		case <-ctx.Done():
+			return nil
+		case err = <-handlerErrChan:
+			return stacktrace.Propagate(err, "lxd event handler error")
+		}
+	}
+	idleCheckTicker = time.NewTicker(config.GetLxd().MaxEventIdle)
+	defer idleCheckTicker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case err = <-handlerErrChan:
+			return stacktrace.Propagate(err, "lxd event handler error")
+		case <-idleCheckTicker.C:
+			if idleTracker.idleFor() <= config.GetLxd().MaxEventIdle {
+				continue
+			}
+			err = checkListenersAlive(lg, listeners, instanceServers)
+			if err != nil {
+				return stacktrace.Propagate(err, "lxd event stream idle for <%s>, liveness probe failed", idleTracker.idleFor())
+			}
+		}
+	}
+}
+
+// checkListenersAlive probes, via a cheap GetServer() call, every remote with at least one listener
+// reporting itself active, returning an error for the first one that fails to answer. It is only
+// called once the event stream has been idle for longer than config.GetLxd().MaxEventIdle, to tell a
+// silently wedged connection (common with long-lived unix socket connections) apart from a remote
+// that is simply quiet.
+func checkListenersAlive(lg log.Logger, listeners map[string][]*lxd.EventListener, instanceServers map[string]lxd.InstanceServer) error {
+	var (
+		err             error
+		remoteName      string
+		remoteActive    bool
+		remoteListeners []*lxd.EventListener
+		listener        *lxd.EventListener
+		instanceServer  lxd.InstanceServer
+	)
+	for remoteName, remoteListeners = range listeners {
+		remoteActive = false
+		for _, listener = range remoteListeners {
+			if listener != nil && listener.IsActive() {
+				remoteActive = true
+				break
+			}
+		}
+		if !remoteActive {
+			continue
+		}
+		instanceServer = instanceServers[remoteName]
+		_, _, err = instanceServer.GetServer()
+		if err != nil {
+			lg.Warningf("liveness probe failed for remote <%s>, event stream considered dead", remoteName)
+			return stacktrace.Propagate(err, "liveness probe failed for remote <%s>", remoteName)
+		}
+	}
+	return nil
+}
+
+// periodicRefreshService periodically triggers a full refresh, as a safety net against missed or
+// dropped LXD events.
+type periodicRefreshService struct {
+	service *Service
+}
+
+// Name identifies the sub-service in logs.
+func (sub *periodicRefreshService) Name() string {
+	return "periodic-refresh"
+}
+
+// Serve implements SubService.
+func (sub *periodicRefreshService) Serve(ctx context.Context) error {
+	var (
+		ticker *time.Ticker
+		lg     log.Logger
+	)
+	lg = log.New("subservice", sub.Name())
+	ticker = time.NewTicker(config.GetLxd().PeriodicRefresh)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+			select {
+			case sub.service.triggerChan <- struct{}{}:
+				lg.Infof("full refresh triggered by ticker")
+			default: // chan is already full, no need to trigger refresh
+				lg.Tracef("ticker refresh cancelled because chan is already full")
+			}
+		}
+	}
+}
+
+// waitForDHCPService triggers a full refresh config.GetLxd().WaitForDHCP after the last received
+// refresh request, giving newly started instances time to obtain a DHCP lease before their
+// network information is re-read from LXD. It is reset by the etcd-persister sub-service every
+// time a RefreshRequest comes in.
+type waitForDHCPService struct {
+	service *Service
+}
+
+// Name identifies the sub-service in logs.
+func (sub *waitForDHCPService) Name() string {
+	return "wait-for-dhcp"
+}
+
+// Serve implements SubService.
+func (sub *waitForDHCPService) Serve(ctx context.Context) error {
+	var (
+		timer *time.Timer
+		lg    log.Logger
+	)
+	lg = log.New("subservice", sub.Name())
+	timer = time.NewTimer(config.GetLxd().WaitForDHCP)
+	if !timer.Stop() {
+		<-timer.C
+	}
+	defer timer.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-sub.service.dhcpResetChan:
+			timer.Reset(config.GetLxd().WaitForDHCP)
+		case <-timer.C:
+			select {
+			case sub.service.triggerChan <- struct{}{}:
+				lg.Infof("refresh triggered by automatic wait for dhcp")
+			default: // chan is already full, no need to trigger refresh
+				lg.Tracef("automatic wait for dhcp cancelled because chan is already full")
+			}
+		}
+	}
+}
+
+// etcdPersisterService owns the etcd client and lease, and is the only sub-service that writes to
+// etcd. It debounces and coalesces RefreshRequests received on service.refreshChan into
+// incremental updates, and performs a full populate/persist whenever service.triggerChan fires.
+type etcdPersisterService struct {
+	service *Service
+}
+
+// Name identifies the sub-service in logs.
+func (sub *etcdPersisterService) Name() string {
+	return "etcd-persister"
+}
+
+// Serve implements SubService.
+func (sub *etcdPersisterService) Serve(ctx context.Context) error {
+	var (
+		err                 error
+		lg                  log.Logger
+		etcdConfig          clientv3.Config
+		etcdClient          *clientv3.Client
+		leaseID             clientv3.LeaseID
+		keepAliveFailedChan chan struct{}
+		debounceTimer       *time.Timer
+		debouncePending     bool
+		pendingRefreshes    map[refreshKey]RefreshRequest
+		req                 RefreshRequest
+		key                 refreshKey
+		lxdInfo             *LxdInfo
+		previous            *LxdInfo
+	)
+	lg = log.New("subservice", sub.Name())
+	sub.service.setEtcdConnected(false)
+	etcdConfig = clientv3.Config{
+		Endpoints:   config.GetEtcd().Endpoints,
+		DialTimeout: config.GetEtcd().DialTimeout,
+		Username:    config.GetEtcd().Username,
+		Password:    config.GetEtcd().Password,
+		Context:     ctx,
+	}
+	lg.Debugf("etcd config: <%#v>", etcdConfig)
+	etcdClient, err = clientv3.New(etcdConfig)
+	if err != nil {
+		return stacktrace.Propagate(err, "fail to initialize etcd client with config <%#v>", etcdConfig)
+	}
+	defer func() {
+		sub.service.setEtcdConnected(false)
+		err = etcdClient.Close()
+		if err != nil {
+			lg.Errorf(stacktrace.Propagate(err, "fail to close etcd client").Error())
+		}
+	}()
+	lg.Debugf("etcd client initialized")
+	keepAliveFailedChan = make(chan struct{}, 1)
+	leaseID, err = grantLease(ctx, etcdClient, keepAliveFailedChan)
+	if err != nil {
+		return stacktrace.Propagate(err, "fail to grant etcd lease")
+	}
+	sub.service.etcdClient = etcdClient
+	sub.service.leaseID = leaseID
+	sub.service.setEtcdConnected(true)
+	debounceTimer = time.NewTimer(time.Hour)
+	if !debounceTimer.Stop() {
+		<-debounceTimer.C
+	}
+	defer debounceTimer.Stop()
+	pendingRefreshes = make(map[refreshKey]RefreshRequest)
+	select {
+	case sub.service.triggerChan <- struct{}{}: // trigger initial full refresh
+	default:
+	}
+	for {
+		lg.Tracef("waiting for refresh")
+		select {
+		case <-ctx.Done():
+			revokeLease(etcdClient, leaseID)
+			return nil
+		case <-keepAliveFailedChan:
+			return stacktrace.NewError("etcd lease keepalive failed, reconnecting")
+		case req = <-sub.service.refreshChan:
+			// coalesce refresh requests for the same object received during the debounce window
+			key = refreshKey{Remote: req.Remote, Location: req.Location, Project: req.Project, Kind: req.Kind, Name: req.Name}
+			pendingRefreshes[key] = req
+			if !debouncePending {
+				debounceTimer.Reset(config.GetLxd().RefreshDebounce)
+				debouncePending = true
+			}
+			select {
+			case sub.service.dhcpResetChan <- struct{}{}:
+			default:
+			}
+		case <-debounceTimer.C:
+			debouncePending = false
+			if !sub.service.isHealthy() {
+				lg.Warningf("cancelling triggered refresh before service initialization")
+				pendingRefreshes = make(map[refreshKey]RefreshRequest)
+				continue
+			}
+			lg.Tracef("processing <%d> coalesced refresh request(s)", len(pendingRefreshes))
+			for _, req = range pendingRefreshes {
+				err = RefreshOne(ctx, etcdClient, sub.service.getRemoteSources(), req, leaseID)
+				if err != nil {
+					return stacktrace.Propagate(err, "fail to process refresh request")
+				}
+			}
+			pendingRefreshes = make(map[refreshKey]RefreshRequest)
+			lg.Infof("etcd updated incrementally")
+		case <-sub.service.triggerChan:
+			if !sub.service.isHealthy() {
+				lg.Warningf("cancelling triggered processing before service initialization")
+				continue
+			}
+			lg.Tracef("processing full refresh")
+			lxdInfo = &LxdInfo{}
+			err = lxdInfo.Populate(sub.service.getRemoteSources())
+			if err != nil {
+				return stacktrace.Propagate(err, "fail to obtain lxd infos")
+			}
+			lg.Debugf("retrieved lxd info:\n%s", lxdInfo.PrettyString())
+			previous = sub.service.lastLxdInfo()
+			if previous == nil {
+				// nothing populated yet in this process: fall back to etcd's own state, so that an
+				// object deleted from LXD while lxd2etcd was down still gets its stale entry cleaned up
+				previous, err = loadPreviousFromEtcd(ctx, etcdClient, sub.service.getRemoteSources())
+				if err != nil {
+					return stacktrace.Propagate(err, "fail to reconstruct previous inventory from etcd")
+				}
+			}
+			err = lxdInfo.Persist(ctx, etcdClient, leaseID, previous)
+			if err != nil {
+				return stacktrace.Propagate(err, "fail to persist data to etcd")
+			}
+			sub.service.setLastPopulated(lxdInfo)
+			lg.Infof("etcd updated")
+		}
+	}
+}